@@ -0,0 +1,402 @@
+package main
+
+import (
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// 自动选择 piece length 时的范围和目标 piece 数量
+	minAutoPieceLength = 16 * 1024
+	maxAutoPieceLength = 16 * 1024 * 1024
+	targetPieceCount   = 1500
+)
+
+// CreateOptions 是 create 命令的参数
+type CreateOptions struct {
+	Path        string     // 要制作 torrent 的文件或目录
+	Trackers    [][]string // tracker 层级，第一个 tracker 同时写入 announce
+	Comment     string
+	Private     bool
+	Hybrid      bool   // 同时生成 v1 和 v2（BEP 52）信息的混合 torrent
+	PieceLength int64  // 0 表示自动选择
+	OutputPath  string // 为空时写到当前目录下的 <name>.torrent
+}
+
+// parseCreateArgs 解析 create 命令的参数
+// create [--tracker <url>[,<url>...]]... [--comment <text>] [--private] [--hybrid] [--piece-length <bytes>] [-o <output>] <path>
+// 每个 --tracker 是 announce-list 中的一层，同一层的多个 tracker 用逗号分隔
+func parseCreateArgs(args []string) (CreateOptions, error) {
+	var opts CreateOptions
+	var trackerArgs []string
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		switch arg {
+		case "--tracker", "-t", "--comment", "--piece-length", "-o", "--output":
+			if i+1 >= len(args) {
+				return opts, fmt.Errorf("%s requires a value", arg)
+			}
+			i++
+			value := args[i]
+			switch arg {
+			case "--tracker", "-t":
+				trackerArgs = append(trackerArgs, value)
+			case "--comment":
+				opts.Comment = value
+			case "--piece-length":
+				pieceLength, err := strconv.ParseInt(value, 10, 64)
+				if err != nil {
+					return opts, fmt.Errorf("invalid piece length: %s", value)
+				}
+				opts.PieceLength = pieceLength
+			default:
+				opts.OutputPath = value
+			}
+		case "--private":
+			opts.Private = true
+		case "--hybrid":
+			opts.Hybrid = true
+		default:
+			if strings.HasPrefix(arg, "-") && arg != "-" {
+				return opts, fmt.Errorf("unknown option %s", arg)
+			}
+			if opts.Path != "" {
+				return opts, fmt.Errorf("unexpected argument %s", arg)
+			}
+			opts.Path = arg
+		}
+	}
+	opts.Trackers = parseTrackerTiers(trackerArgs)
+	if opts.Path == "" {
+		return opts, errors.New("usage: create [--tracker <url>] [--comment <text>] [--private] [--hybrid] [--piece-length <bytes>] [-o <output>] <path>")
+	}
+	return opts, nil
+}
+
+// parseTrackerTiers 把每个 --tracker 参数转换为 announce-list 中的一层，create 和 edit 命令共用
+// 同一层的多个 tracker 用逗号分隔，忽略空白和空项，没有 tracker 的参数不产生空层
+func parseTrackerTiers(values []string) [][]string {
+	var tiers [][]string
+	for _, value := range values {
+		var tier []string
+		for _, trackerURL := range strings.Split(value, ",") {
+			if trackerURL = strings.TrimSpace(trackerURL); trackerURL != "" {
+				tier = append(tier, trackerURL)
+			}
+		}
+		if len(tier) > 0 {
+			tiers = append(tiers, tier)
+		}
+	}
+	return tiers
+}
+
+// createTorrent 根据文件或目录生成 torrent，返回生成的 Metainfo（InfoBytes 和 InfoHash 都已填好）
+func createTorrent(opts CreateOptions) (*Metainfo, error) {
+	root, err := filepath.Abs(opts.Path)
+	if err != nil {
+		return nil, fmt.Errorf("error resolving path: %v", err)
+	}
+	stat, err := os.Stat(root)
+	if err != nil {
+		return nil, fmt.Errorf("error reading path: %v", err)
+	}
+
+	info := InfoDict{Name: filepath.Base(root)}
+	if stat.IsDir() {
+		info.FileList, err = collectFiles(root)
+		if err != nil {
+			return nil, err
+		}
+		if len(info.FileList) == 0 {
+			return nil, fmt.Errorf("error: directory %s contains no files", opts.Path)
+		}
+	} else if stat.Mode().IsRegular() {
+		info.Length = stat.Size()
+	} else {
+		return nil, fmt.Errorf("error: %s is not a regular file or directory", opts.Path)
+	}
+
+	totalLength := info.TotalLength()
+	if totalLength == 0 {
+		return nil, errors.New("error: cannot create a torrent for empty content")
+	}
+	info.PieceLength = opts.PieceLength
+	if info.PieceLength == 0 {
+		info.PieceLength = choosePieceLength(totalLength)
+	}
+	// piece length 必须是 2 的幂，且不小于一个 block（16 KiB）
+	if info.PieceLength < minAutoPieceLength || info.PieceLength&(info.PieceLength-1) != 0 {
+		return nil, fmt.Errorf("error: piece length %d must be a power of two and at least %d", info.PieceLength, minAutoPieceLength)
+	}
+	info.Private = opts.Private
+	if opts.Hybrid {
+		// v2 的文件与 v1 的文件顺序相同，v1 中插入填充文件，让每个文件都从 piece 边界开始
+		info.V2Files = v2FilesFromV1(&info)
+		if info.IsMultiFile() {
+			info.FileList = addPaddingFiles(info.FileList, info.PieceLength)
+		}
+	}
+
+	// 多文件 torrent 的数据位于 root 目录下，单文件 torrent 就是 root 本身，与下载时的文件布局一致
+	storage, err := newFileStorage(&info, root)
+	if err != nil {
+		return nil, err
+	}
+	info.Pieces, err = hashPieces(storage, &info)
+	if err != nil {
+		return nil, err
+	}
+
+	meta := &Metainfo{
+		Comment:      opts.Comment,
+		CreatedBy:    "bittorrent-starter-go",
+		CreationDate: time.Now().Unix(),
+	}
+	if opts.Hybrid {
+		info.MetaVersion = 2
+		info.FileTree, meta.PieceLayers, err = buildFileTree(info.V2Files, info.PieceLength)
+		if err != nil {
+			return nil, err
+		}
+	}
+	meta.InfoBytes, err = Marshal(info)
+	if err != nil {
+		return nil, fmt.Errorf("error encoding info dictionary: %v", err)
+	}
+	if len(opts.Trackers) > 0 {
+		meta.Announce = opts.Trackers[0][0]
+		// 只有一个 tracker 时不需要 announce-list
+		if len(opts.Trackers) > 1 || len(opts.Trackers[0]) > 1 {
+			meta.AnnounceList = opts.Trackers
+		}
+	}
+
+	// 按读取 torrent 文件的方式重新解析一遍，填好 info hash，同时校验生成的结果
+	encoded, err := Marshal(meta)
+	if err != nil {
+		return nil, fmt.Errorf("error encoding torrent: %v", err)
+	}
+	node, err := decodeBencodeBytes(encoded, BencodeStrict)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding created torrent: %v", err)
+	}
+	return parseMetainfo(node)
+}
+
+// v2FilesFromV1 根据 v1 的文件列表生成 v2 的文件列表（还没有计算哈希）
+// 单文件 torrent 在 file tree 中是一个以 name 为键的顶层文件，多文件 torrent 的路径与 files 中的相同
+func v2FilesFromV1(info *InfoDict) []V2File {
+	if !info.IsMultiFile() {
+		return []V2File{{Path: []string{info.Name}, Length: info.Length}}
+	}
+	files := make([]V2File, 0, len(info.FileList))
+	for _, file := range info.FileList {
+		files = append(files, V2File{Path: file.Path, Length: file.Length})
+	}
+	return files
+}
+
+// addPaddingFiles 在每个长度不是 piece length 整数倍的文件后面插入填充文件（BEP 47），最后一个文件除外
+func addPaddingFiles(files []FileDict, pieceLength int64) []FileDict {
+	padded := make([]FileDict, 0, len(files)*2)
+	for i, file := range files {
+		padded = append(padded, file)
+		if i == len(files)-1 || file.Length%pieceLength == 0 {
+			continue
+		}
+		padLength := pieceLength - file.Length%pieceLength
+		padded = append(padded, FileDict{
+			Length: padLength,
+			Path:   []string{".pad", strconv.FormatInt(padLength, 10)},
+			Attr:   "p",
+		})
+	}
+	return padded
+}
+
+// buildFileTree 根据计算好哈希的 v2 文件列表生成 file tree 和 piece layers
+func buildFileTree(files []V2File, pieceLength int64) (RawBencode, map[string][]byte, error) {
+	tree := make(map[string]interface{})
+	pieceLayers := make(map[string][]byte)
+	for _, file := range files {
+		entry := map[string]interface{}{"length": file.Length}
+		if file.Length > 0 {
+			entry["pieces root"] = file.PiecesRoot[:]
+		}
+		if file.Length > pieceLength {
+			layer := make([]byte, 0, len(file.PieceLayer)*32)
+			for _, hash := range file.PieceLayer {
+				layer = append(layer, hash[:]...)
+			}
+			pieceLayers[string(file.PiecesRoot[:])] = layer
+		}
+		// 按路径逐级创建目录节点，文件节点是 {"": entry}
+		node := tree
+		for _, component := range file.Path[:len(file.Path)-1] {
+			child, ok := node[component].(map[string]interface{})
+			if !ok {
+				child = make(map[string]interface{})
+				node[component] = child
+			}
+			node = child
+		}
+		node[file.Path[len(file.Path)-1]] = map[string]interface{}{"": entry}
+	}
+	encoded, err := encodeBencode(tree)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error encoding file tree: %v", err)
+	}
+	return RawBencode(encoded), pieceLayers, nil
+}
+
+// collectFiles 按路径的字典序列出目录下的所有普通文件，路径相对于 root
+// 符号链接和其他特殊文件会被跳过
+func collectFiles(root string) ([]FileDict, error) {
+	var files []FileDict
+	err := filepath.WalkDir(root, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !entry.Type().IsRegular() {
+			return nil
+		}
+		fileInfo, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		files = append(files, FileDict{Length: fileInfo.Size(), Path: strings.Split(filepath.ToSlash(rel), "/")})
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error reading directory: %v", err)
+	}
+	return files, nil
+}
+
+// choosePieceLength 自动选择 piece length：在 16 KiB ~ 16 MiB 之间取 2 的幂，使 piece 数量接近 targetPieceCount
+func choosePieceLength(totalLength int64) int64 {
+	pieceLength := int64(minAutoPieceLength)
+	for pieceLength < maxAutoPieceLength && totalLength/pieceLength > targetPieceCount {
+		pieceLength *= 2
+	}
+	return pieceLength
+}
+
+// hashPieces 并发计算所有 piece 的 SHA-1 哈希，返回连接在一起的哈希
+// 混合 torrent 同时计算每个 piece 在 v2 merkle 树中的哈希，并填好 V2Files 的 piece 层和 pieces root
+func hashPieces(storage *FileStorage, info *InfoDict) ([]byte, error) {
+	dataLength := info.dataLength()
+	pieceLength := info.PieceLength
+	numPieces := int((dataLength + pieceLength - 1) / pieceLength)
+	pieces := make([]byte, numPieces*20)
+	for i := range info.V2Files {
+		file := &info.V2Files[i]
+		file.PieceLayer = make([][32]byte, (file.Length+pieceLength-1)/pieceLength)
+	}
+
+	indexes := make(chan int)
+	var wg sync.WaitGroup
+	var errOnce sync.Once
+	var firstErr error
+	for w := 0; w < runtime.NumCPU(); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			buffer := make([]byte, pieceLength)
+			for pieceIndex := range indexes {
+				offset := int64(pieceIndex) * pieceLength
+				data := buffer[:min(pieceLength, dataLength-offset)]
+				_, err := storage.ReadAt(data, offset)
+				if err == nil && len(info.V2Files) > 0 {
+					var hash [32]byte
+					var file *V2File
+					var indexInFile int
+					hash, file, indexInFile, err = info.v2PieceHash(pieceIndex, data)
+					if err == nil {
+						file.PieceLayer[indexInFile] = hash
+					}
+				}
+				if err != nil {
+					errOnce.Do(func() { firstErr = fmt.Errorf("error hashing piece %d: %v", pieceIndex, err) })
+					continue
+				}
+				// 每个 worker 只写自己负责的 piece 对应的位置，不需要加锁
+				hash := sha1.Sum(data)
+				copy(pieces[pieceIndex*20:], hash[:])
+			}
+		}()
+	}
+	for pieceIndex := 0; pieceIndex < numPieces; pieceIndex++ {
+		indexes <- pieceIndex
+	}
+	close(indexes)
+	wg.Wait()
+	if firstErr != nil {
+		return nil, firstErr
+	}
+
+	// 由 piece 层计算每个文件的 pieces root
+	pad := merklePadHash(int(pieceLength / merkleBlockSize))
+	for i := range info.V2Files {
+		file := &info.V2Files[i]
+		switch {
+		case file.Length == 0:
+			file.PieceLayer = nil
+		case file.Length <= pieceLength:
+			// 只有一个 piece，它的哈希就是 pieces root
+			file.PiecesRoot = file.PieceLayer[0]
+			file.PieceLayer = nil
+		default:
+			file.PiecesRoot = merkleRoot(file.PieceLayer, nextPowerOfTwo(len(file.PieceLayer)), pad)
+		}
+	}
+	return pieces, nil
+}
+
+// writeTorrentFile 把 Metainfo 编码后写入文件
+func writeTorrentFile(meta *Metainfo, outputPath string) error {
+	encoded, err := Marshal(meta)
+	if err != nil {
+		return fmt.Errorf("error encoding torrent: %v", err)
+	}
+	err = os.WriteFile(outputPath, encoded, 0644)
+	if err != nil {
+		return fmt.Errorf("error writing torrent file: %v", err)
+	}
+	return nil
+}
+
+// create 实现 create 命令，返回要输出的信息
+func create(opts CreateOptions) (string, error) {
+	meta, err := createTorrent(opts)
+	if err != nil {
+		return "", err
+	}
+	outputPath := opts.OutputPath
+	if outputPath == "" {
+		outputPath = meta.Info.Name + ".torrent"
+	}
+	err = writeTorrentFile(meta, outputPath)
+	if err != nil {
+		return "", err
+	}
+	response := fmt.Sprintf("Created: %s\nInfo Hash: %x", outputPath, meta.InfoHash)
+	if meta.Info.IsV2() {
+		response += fmt.Sprintf("\nInfo Hash v2: %x", meta.InfoHashV2)
+	}
+	return response + fmt.Sprintf("\nPiece Length: %d\nPieces: %d", meta.Info.PieceLength, meta.Info.NumPieces()), nil
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseTrackerTiers(t *testing.T) {
+	args := []string{"-t", "http://a/announce, http://b/announce", "--tracker", " , ", "--tracker", "udp://c:80", "x"}
+	expected := [][]string{{"http://a/announce", "http://b/announce"}, {"udp://c:80"}}
+
+	createOpts, err := parseCreateArgs(args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(createOpts.Trackers, expected) {
+		t.Fatalf("create trackers %q, expected %q", createOpts.Trackers, expected)
+	}
+	editOpts, err := parseEditArgs(args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(editOpts.Trackers, expected) {
+		t.Fatalf("edit trackers %q, expected %q", editOpts.Trackers, expected)
+	}
+	if tiers := parseTrackerTiers(nil); tiers != nil {
+		t.Fatalf("expected no tiers, got %q", tiers)
+	}
+}
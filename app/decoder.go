@@ -0,0 +1,485 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// BencodeMode 控制解码器如何对待合法但不符合规范形式（BEP 3）的输入
+type BencodeMode int
+
+const (
+	// BencodeLenient 接受现实中常见的非规范写法（前导零、i-0e、未排序或重复的键、末尾多余数据），
+	// 并把它们记录在节点的 Issues 中
+	BencodeLenient BencodeMode = iota
+	// BencodeStrict 只接受规范形式，遇到任何非规范写法立即返回错误
+	BencodeStrict
+)
+
+func (m BencodeMode) String() string {
+	if m == BencodeStrict {
+		return "strict"
+	}
+	return "lenient"
+}
+
+// BencodeSyntaxError 描述解码失败的模式、字节偏移和原因
+type BencodeSyntaxError struct {
+	Mode   BencodeMode
+	Offset int64
+	Reason string
+}
+
+func (e *BencodeSyntaxError) Error() string {
+	return fmt.Sprintf("invalid bencoded data (%s mode) at offset %d: %s", e.Mode, e.Offset, e.Reason)
+}
+
+// BencodeLimits 限制解码器愿意处理的输入规模
+// tracker 响应和 peer 的扩展消息都来自不可信的网络输入，不加限制的话，
+// 恶意构造的数据可以通过深度嵌套导致栈溢出，或通过巨大的长度前缀导致巨量内存分配
+// 字段为 0 表示不限制
+type BencodeLimits struct {
+	MaxDepth     int   // 列表/字典的最大嵌套深度
+	MaxStringLen int64 // 单个字符串的最大长度
+	MaxTotalSize int64 // 单个顶层值的最大字节数
+}
+
+// defaultBencodeLimits 足够容纳超大 torrent 的 pieces 字段，同时拒绝明显异常的输入
+var defaultBencodeLimits = BencodeLimits{
+	MaxDepth:     64,
+	MaxStringLen: 64 << 20,
+	MaxTotalSize: 128 << 20,
+}
+
+// maxLengthPrefixDigits 是字符串长度前缀允许的最大位数（超过就不可能是合法的 int64）
+const maxLengthPrefixDigits = 19
+
+// maxIntegerDigits 是整数允许的最大位数
+// 超出 int64 范围的整数会以 *big.Int 保存，但没有必要接受成千上万位的数字
+const maxIntegerDigits = 256
+
+// BencodeIssue 是宽松模式下接受的一处非规范写法
+type BencodeIssue struct {
+	Offset int64
+	Reason string
+}
+
+// BencodeNode 是流式解码得到的一个值，除了解码后的 Go 值外，还记录了它在输入中的位置和原始字节
+type BencodeNode struct {
+	Kind   byte        // 's' 字符串, 'i' 整数, 'l' 列表, 'd' 字典
+	Value  interface{} // 解码后的 Go 值（string / int64 / *big.Int / []interface{} / map[string]interface{}），encodeBencode 可以直接编码回去
+	Offset int64       // 该值在输入流中的起始字节偏移
+	Raw    []byte      // 该值在输入中的原始字节（包括长度前缀、'i'/'l'/'d' 和结束符 'e'）
+
+	List []*BencodeNode          // Kind == 'l' 时的子节点
+	Keys []string                // Kind == 'd' 时按输入顺序排列的键
+	Dict map[string]*BencodeNode // Kind == 'd' 时的子节点
+
+	Issues []BencodeIssue // 宽松模式下该值中出现的非规范写法（不包括子节点的）
+
+	end int64 // 该值结束位置（不包含），解码完成后用于切出 Raw
+}
+
+// Length 返回该值在输入中占用的字节数
+func (n *BencodeNode) Length() int64 {
+	return int64(len(n.Raw))
+}
+
+// Get 返回字典节点中指定键对应的子节点，不存在或不是字典时返回 nil
+func (n *BencodeNode) Get(key string) *BencodeNode {
+	if n == nil || n.Kind != 'd' {
+		return nil
+	}
+	return n.Dict[key]
+}
+
+// BencodeDecoder 从 io.Reader 中逐个读取 bencode 值
+// 它不需要把整个输入读进内存再解析，并且会保留每个值的原始字节，
+// 调用者可以直接对原始字节计算哈希（例如 info 字典）
+type BencodeDecoder struct {
+	Mode   BencodeMode   // 默认为宽松模式
+	Limits BencodeLimits // 默认为 defaultBencodeLimits
+
+	r      *bufio.Reader
+	offset int64  // 已经从输入中消费的字节数
+	buf    []byte // 当前顶层值已经读取的原始字节
+	start  int64  // 当前顶层值的起始偏移
+	depth  int    // 当前列表/字典的嵌套深度
+}
+
+// NewBencodeDecoder 创建一个从 r 读取的流式解码器
+func NewBencodeDecoder(r io.Reader) *BencodeDecoder {
+	br, ok := r.(*bufio.Reader)
+	if !ok {
+		br = bufio.NewReader(r)
+	}
+	return &BencodeDecoder{r: br, Limits: defaultBencodeLimits}
+}
+
+// InputOffset 返回已经消费的字节数，也就是下一个值的起始偏移
+func (d *BencodeDecoder) InputOffset() int64 {
+	return d.offset
+}
+
+// Remaining 返回尚未被解码器消费的输入
+// 例如 ut_metadata 的 data 消息在字典之后紧跟着元数据内容，可以通过它读取剩余字节
+func (d *BencodeDecoder) Remaining() io.Reader {
+	return d.r
+}
+
+// Decode 读取下一个完整的 bencode 值
+// 输入在两个值之间正好结束时返回 io.EOF
+func (d *BencodeDecoder) Decode() (*BencodeNode, error) {
+	if _, err := d.r.Peek(1); err == io.EOF {
+		return nil, io.EOF
+	}
+
+	// 每个顶层值使用新的缓冲区，之前返回的节点的 Raw 仍然有效
+	d.buf = nil
+	d.start = d.offset
+	d.depth = 0
+	node, err := d.decodeValue()
+	if err != nil {
+		return nil, err
+	}
+	fillRaw(node, d.buf, d.start)
+	return node, nil
+}
+
+// ExpectEOF 检查顶层值之后是否还有多余的数据
+// 严格模式下返回错误，宽松模式下记录到 root 的 Issues 中
+func (d *BencodeDecoder) ExpectEOF(root *BencodeNode) error {
+	if _, err := d.r.Peek(1); err == io.EOF {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	return d.nonCanonical(root, d.offset, "trailing data after top-level value")
+}
+
+// decodeBencodeBytes 按指定模式解码一段完整的输入，顶层值之后不能有多余数据（宽松模式下只记录）
+func decodeBencodeBytes(data []byte, mode BencodeMode) (*BencodeNode, error) {
+	return decodeBencodeReader(bytes.NewReader(data), mode)
+}
+
+// decodeBencodeReader 与 decodeBencodeBytes 相同，但直接从 r 流式读取（文件、标准输入等）
+func decodeBencodeReader(r io.Reader, mode BencodeMode) (*BencodeNode, error) {
+	d := NewBencodeDecoder(r)
+	d.Mode = mode
+	node, err := d.Decode()
+	if err == io.EOF {
+		return nil, d.errorAt(0, "empty input")
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := d.ExpectEOF(node); err != nil {
+		return nil, err
+	}
+	return node, nil
+}
+
+// fillRaw 在顶层值解码完成后，为每个节点切出原始字节（所有节点共享同一块底层内存）
+func fillRaw(node *BencodeNode, buf []byte, base int64) {
+	node.Raw = buf[node.Offset-base : node.end-base : node.end-base]
+	for _, child := range node.List {
+		fillRaw(child, buf, base)
+	}
+	for _, child := range node.Dict {
+		fillRaw(child, buf, base)
+	}
+}
+
+func (d *BencodeDecoder) peekByte() (byte, error) {
+	b, err := d.r.Peek(1)
+	if err != nil {
+		if err == io.EOF {
+			return 0, d.errorf("unexpected end of input")
+		}
+		return 0, err
+	}
+	return b[0], nil
+}
+
+func (d *BencodeDecoder) readByte() (byte, error) {
+	if err := d.checkTotalSize(1); err != nil {
+		return 0, err
+	}
+	b, err := d.r.ReadByte()
+	if err != nil {
+		if err == io.EOF {
+			return 0, d.errorf("unexpected end of input")
+		}
+		return 0, err
+	}
+	d.buf = append(d.buf, b)
+	d.offset++
+	return b, nil
+}
+
+// checkTotalSize 检查再读取 n 个字节后当前顶层值是否会超过 MaxTotalSize
+func (d *BencodeDecoder) checkTotalSize(n int64) error {
+	if d.Limits.MaxTotalSize > 0 && d.offset-d.start+n > d.Limits.MaxTotalSize {
+		return d.errorf("value exceeds maximum size of %d bytes", d.Limits.MaxTotalSize)
+	}
+	return nil
+}
+
+// enter 进入一层列表/字典，超过最大嵌套深度时返回错误
+func (d *BencodeDecoder) enter() error {
+	d.depth++
+	if d.Limits.MaxDepth > 0 && d.depth > d.Limits.MaxDepth {
+		return d.errorf("nesting depth exceeds maximum of %d", d.Limits.MaxDepth)
+	}
+	return nil
+}
+
+func (d *BencodeDecoder) errorf(format string, args ...interface{}) error {
+	return d.errorAt(d.offset, format, args...)
+}
+
+func (d *BencodeDecoder) errorAt(offset int64, format string, args ...interface{}) error {
+	return &BencodeSyntaxError{Mode: d.Mode, Offset: offset, Reason: fmt.Sprintf(format, args...)}
+}
+
+// nonCanonical 处理合法但不符合规范形式的写法：严格模式下返回错误，宽松模式下记录到节点上
+func (d *BencodeDecoder) nonCanonical(node *BencodeNode, offset int64, reason string) error {
+	if d.Mode == BencodeStrict {
+		return d.errorAt(offset, "%s", reason)
+	}
+	node.Issues = append(node.Issues, BencodeIssue{Offset: offset, Reason: reason})
+	return nil
+}
+
+func isDigits(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		if s[i] < '0' || s[i] > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+func (d *BencodeDecoder) decodeValue() (*BencodeNode, error) {
+	b, err := d.peekByte()
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case b >= '0' && b <= '9':
+		return d.decodeString()
+	case b == 'i':
+		return d.decodeInt()
+	case b == 'l':
+		return d.decodeList()
+	case b == 'd':
+		return d.decodeDict()
+	default:
+		return nil, d.errorf("unexpected byte %q", b)
+	}
+}
+
+// readUntil 读取直到遇到 delim，返回 delim 之前的内容（delim 本身被消费但不返回）
+// maxLen 大于 0 时，内容超过 maxLen 字节就返回错误
+func (d *BencodeDecoder) readUntil(delim byte, maxLen int) (string, error) {
+	start := len(d.buf)
+	for {
+		b, err := d.readByte()
+		if err != nil {
+			return "", err
+		}
+		if b == delim {
+			return string(d.buf[start : len(d.buf)-1]), nil
+		}
+		if maxLen > 0 && len(d.buf)-start > maxLen {
+			return "", d.errorf("missing %q after %d bytes", delim, maxLen)
+		}
+	}
+}
+
+func (d *BencodeDecoder) decodeString() (*BencodeNode, error) {
+	node := &BencodeNode{Kind: 's', Offset: d.offset}
+	lengthStr, err := d.readUntil(':', maxLengthPrefixDigits)
+	if err != nil {
+		return nil, err
+	}
+	if !isDigits(lengthStr) {
+		return nil, d.errorAt(node.Offset, "invalid string length %q", lengthStr)
+	}
+	length, err := strconv.ParseInt(lengthStr, 10, 64)
+	if err != nil {
+		return nil, d.errorAt(node.Offset, "invalid string length %q", lengthStr)
+	}
+	// 在分配任何内存之前，先根据限制检查长度前缀
+	if d.Limits.MaxStringLen > 0 && length > d.Limits.MaxStringLen {
+		return nil, d.errorAt(node.Offset, "string length %d exceeds maximum of %d", length, d.Limits.MaxStringLen)
+	}
+	if err := d.checkTotalSize(length); err != nil {
+		return nil, err
+	}
+	if len(lengthStr) > 1 && lengthStr[0] == '0' {
+		if err := d.nonCanonical(node, node.Offset, "leading zero in string length"); err != nil {
+			return nil, err
+		}
+	}
+
+	// 分块读取字符串内容，避免根据一个不可信的长度前缀一次性分配大块内存
+	start := len(d.buf)
+	remaining := length
+	for remaining > 0 {
+		n := min(remaining, 32*1024)
+		old := len(d.buf)
+		d.buf = slices.Grow(d.buf, int(n))[:old+int(n)]
+		read, err := io.ReadFull(d.r, d.buf[old:])
+		d.buf = d.buf[:old+read]
+		d.offset += int64(read)
+		remaining -= int64(read)
+		if err != nil {
+			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+				return nil, d.errorAt(node.Offset, "string length %d exceeds input", length)
+			}
+			return nil, err
+		}
+	}
+	node.Value = string(d.buf[start:])
+	node.end = d.offset
+	return node, nil
+}
+
+func (d *BencodeDecoder) decodeInt() (*BencodeNode, error) {
+	node := &BencodeNode{Kind: 'i', Offset: d.offset}
+	if _, err := d.readByte(); err != nil { // 跳过 'i'
+		return nil, err
+	}
+	valueStr, err := d.readUntil('e', maxIntegerDigits+1)
+	if err != nil {
+		return nil, err
+	}
+	digits := strings.TrimPrefix(valueStr, "-")
+	if !isDigits(digits) {
+		return nil, d.errorAt(node.Offset, "invalid integer %q", valueStr)
+	}
+	if valueStr == "-0" {
+		if err := d.nonCanonical(node, node.Offset, "negative zero"); err != nil {
+			return nil, err
+		}
+	} else if len(digits) > 1 && digits[0] == '0' {
+		if err := d.nonCanonical(node, node.Offset, "leading zero in integer"); err != nil {
+			return nil, err
+		}
+	}
+	// 整数一律按 64 位解析，超出 int64 范围时退回到任意精度，由使用者决定是否接受
+	value, err := strconv.ParseInt(valueStr, 10, 64)
+	if err == nil {
+		node.Value = value
+	} else {
+		bigValue, ok := new(big.Int).SetString(valueStr, 10)
+		if !ok {
+			return nil, d.errorAt(node.Offset, "invalid integer %q", valueStr)
+		}
+		node.Value = bigValue
+	}
+	node.end = d.offset
+	return node, nil
+}
+
+func (d *BencodeDecoder) decodeList() (*BencodeNode, error) {
+	node := &BencodeNode{Kind: 'l', Offset: d.offset}
+	if err := d.enter(); err != nil {
+		return nil, err
+	}
+	defer func() { d.depth-- }()
+	if _, err := d.readByte(); err != nil { // 跳过 'l'
+		return nil, err
+	}
+	values := make([]interface{}, 0)
+	for {
+		b, err := d.peekByte()
+		if err != nil {
+			return nil, err
+		}
+		if b == 'e' {
+			break
+		}
+		child, err := d.decodeValue()
+		if err != nil {
+			return nil, err
+		}
+		node.List = append(node.List, child)
+		values = append(values, child.Value)
+	}
+	if _, err := d.readByte(); err != nil { // 跳过 'e'
+		return nil, err
+	}
+	node.Value = values
+	node.end = d.offset
+	return node, nil
+}
+
+func (d *BencodeDecoder) decodeDict() (*BencodeNode, error) {
+	node := &BencodeNode{Kind: 'd', Offset: d.offset, Dict: make(map[string]*BencodeNode)}
+	if err := d.enter(); err != nil {
+		return nil, err
+	}
+	defer func() { d.depth-- }()
+	if _, err := d.readByte(); err != nil { // 跳过 'd'
+		return nil, err
+	}
+	values := make(map[string]interface{})
+	prevKey := ""
+	for {
+		b, err := d.peekByte()
+		if err != nil {
+			return nil, err
+		}
+		if b == 'e' {
+			break
+		}
+		if b < '0' || b > '9' {
+			return nil, d.errorf("dictionary key must be a string")
+		}
+		keyNode, err := d.decodeString()
+		if err != nil {
+			return nil, err
+		}
+		key := keyNode.Value.(string)
+		// 规范形式要求键按原始字节序严格递增（既不能乱序也不能重复）
+		if _, exists := node.Dict[key]; exists {
+			if err := d.nonCanonical(node, keyNode.Offset, fmt.Sprintf("duplicate dictionary key %q", key)); err != nil {
+				return nil, err
+			}
+		} else if len(node.Keys) > 0 && key < prevKey {
+			if err := d.nonCanonical(node, keyNode.Offset, fmt.Sprintf("dictionary key %q is not sorted (after %q)", key, prevKey)); err != nil {
+				return nil, err
+			}
+		}
+		prevKey = key
+		// 键本身的非规范写法（例如长度前缀的前导零）记录在字典节点上
+		node.Issues = append(node.Issues, keyNode.Issues...)
+		child, err := d.decodeValue()
+		if err != nil {
+			return nil, err
+		}
+		if _, exists := node.Dict[key]; !exists {
+			node.Keys = append(node.Keys, key)
+		}
+		node.Dict[key] = child
+		values[key] = child.Value
+	}
+	if _, err := d.readByte(); err != nil { // 跳过 'e'
+		return nil, err
+	}
+	node.Value = values
+	node.end = d.offset
+	return node, nil
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+)
+
+// bencodeSeeds 是解码相关 fuzz 测试的初始语料
+var bencodeSeeds = []string{
+	"i0e", "i-42e", "i123456789012345678901234567890e", "0:", "4:spam",
+	"le", "l4:spami42ee", "de", "d3:cow3:moo4:spaml1:a1:bee",
+	"d4:infod6:lengthi1e4:name1:a12:piece lengthi16384e6:pieces20:aaaaaaaaaaaaaaaaaaaaee",
+	"i-0e", "i03e", "03:abc", "d1:b0:1:a0:e", "d1:a0:1:a0:e", "l", "d", "i", "5:abc", "lllllllee",
+}
+
+// 分隔符的读取同样受 MaxTotalSize 限制，超出时必须报错而不是得到被截断的 Raw
+func TestDecodeDelimiterRespectsMaxTotalSize(t *testing.T) {
+	cases := []struct {
+		input string
+		limit int64
+	}{
+		{"l4:spame", 7},
+		{"d1:a0:e", 6},
+		{"i42e", 3},
+		{"le", 1},
+		{"de", 1},
+	}
+	for _, c := range cases {
+		d := NewBencodeDecoder(bytes.NewReader([]byte(c.input)))
+		d.Limits.MaxTotalSize = c.limit
+		node, err := d.Decode()
+		if err == nil {
+			t.Errorf("%q with MaxTotalSize %d: decoded %q, expected size error", c.input, c.limit, node.Raw)
+		}
+	}
+	for _, c := range cases {
+		d := NewBencodeDecoder(bytes.NewReader([]byte(c.input)))
+		d.Limits.MaxTotalSize = c.limit + 1
+		node, err := d.Decode()
+		if err != nil {
+			t.Errorf("%q with MaxTotalSize %d: %v", c.input, c.limit+1, err)
+		} else if string(node.Raw) != c.input {
+			t.Errorf("%q: raw is %q", c.input, node.Raw)
+		}
+	}
+}
+
+// 严格模式拒绝非规范写法，错误中给出出错值的偏移和原因；宽松模式接受同样的输入
+func TestDecodeStrictRejections(t *testing.T) {
+	cases := []struct {
+		input  string
+		offset int
+		reason string
+	}{
+		{"i01e", 0, "leading zero in integer"},
+		{"i-01e", 0, "leading zero in integer"},
+		{"l1:ai007ee", 4, "leading zero in integer"},
+		{"i-0e", 0, "negative zero"},
+		{"li1ei-0ee", 4, "negative zero"},
+		{"03:abc", 0, "leading zero in string length"},
+		{"l03:abce", 1, "leading zero in string length"},
+		{"d1:bi1e1:ai2ee", 7, `dictionary key "a" is not sorted (after "b")`},
+		{"d1:ad2:zz0:2:yy0:ee", 11, `dictionary key "yy" is not sorted (after "zz")`},
+		{"d1:ai1e1:ai2ee", 7, `duplicate dictionary key "a"`},
+		{"i1ei2e", 3, "trailing data after top-level value"},
+		{"d1:ai1ee5:x", 8, "trailing data after top-level value"},
+		{"4:spam\n", 6, "trailing data after top-level value"},
+	}
+	for _, c := range cases {
+		_, err := decodeBencodeBytes([]byte(c.input), BencodeStrict)
+		expected := fmt.Sprintf("invalid bencoded data (strict mode) at offset %d: %s", c.offset, c.reason)
+		if err == nil || err.Error() != expected {
+			t.Errorf("%q: got error %v, expected %q", c.input, err, expected)
+		}
+		if _, err := decodeBencodeBytes([]byte(c.input), BencodeLenient); err != nil {
+			t.Errorf("%q: lenient mode: %v", c.input, err)
+		}
+	}
+}
+
+// FuzzDecode 检查任意输入都不会让解码器崩溃，解码成功时原始字节必须是输入的前缀
+// （宽松模式会把顶层值之后的多余数据记录为 Issue，严格模式下必须等于整个输入）
+func FuzzDecode(f *testing.F) {
+	for _, seed := range bencodeSeeds {
+		f.Add([]byte(seed))
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		for _, mode := range []BencodeMode{BencodeLenient, BencodeStrict} {
+			node, err := decodeBencodeBytes(data, mode)
+			if err != nil {
+				continue
+			}
+			if !bytes.HasPrefix(data, node.Raw) {
+				t.Fatalf("mode %v: raw %q is not a prefix of input %q", mode, node.Raw, data)
+			}
+			if mode == BencodeStrict && len(node.Raw) != len(data) {
+				t.Fatalf("strict mode accepted trailing data in %q", data)
+			}
+		}
+	})
+}
+
+// FuzzEncodeRoundTrip 检查严格模式接受的输入重新编码后与输入完全相同，
+// 宽松模式接受的输入重新编码后能被严格模式接受，并且解码出相同的值
+func FuzzEncodeRoundTrip(f *testing.F) {
+	for _, seed := range bencodeSeeds {
+		f.Add([]byte(seed))
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		node, err := decodeBencodeBytes(data, BencodeLenient)
+		if err != nil {
+			return
+		}
+		encoded, err := encodeBencode(node.Value)
+		if err != nil {
+			t.Fatalf("encoding value decoded from %q: %v", data, err)
+		}
+		canonical, err := decodeBencodeBytes([]byte(encoded), BencodeStrict)
+		if err != nil {
+			t.Fatalf("re-encoded %q is not canonical: %v", encoded, err)
+		}
+		again, err := encodeBencode(canonical.Value)
+		if err != nil || again != encoded {
+			t.Fatalf("second round trip of %q gave %q (%v)", encoded, again, err)
+		}
+		if _, err := decodeBencodeBytes(data, BencodeStrict); err == nil && encoded != string(data) {
+			t.Fatalf("strict input %q re-encoded as %q", data, encoded)
+		}
+	})
+}
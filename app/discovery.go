@@ -0,0 +1,70 @@
+package main
+
+import "fmt"
+
+// PeerSource 是获取 peer 地址的一种来源
+type PeerSource int
+
+const (
+	PeerSourceTracker PeerSource = iota // metainfo 中的 tracker（announce / announce-list）
+	PeerSourceDHT                       // BEP 5
+	PeerSourcePEX                       // BEP 11，通过已连接的 peer 交换地址
+	PeerSourceLSD                       // BEP 14，局域网内组播发现
+)
+
+func (s PeerSource) String() string {
+	switch s {
+	case PeerSourceTracker:
+		return "tracker"
+	case PeerSourceDHT:
+		return "dht"
+	case PeerSourcePEX:
+		return "pex"
+	case PeerSourceLSD:
+		return "lsd"
+	}
+	return fmt.Sprintf("PeerSource(%d)", int(s))
+}
+
+// DiscoveryPolicy 决定一个 torrent 可以从哪些来源获取 peer
+// BEP 27：私有 torrent 只能使用 metainfo 中的 tracker，不能通过 DHT、PEX、LSD 查找 peer，
+// 也不能把自己公布到这些网络中，否则 torrent 会泄露到 tracker 之外
+type DiscoveryPolicy struct {
+	Private bool
+}
+
+// DiscoveryPolicy 返回这个 torrent 的 peer 来源策略
+func (info *InfoDict) DiscoveryPolicy() DiscoveryPolicy {
+	return DiscoveryPolicy{Private: info.Private}
+}
+
+// unknownDiscoveryPolicy 用于还没有获取元数据的磁力链接
+// 这时不知道 torrent 是否私有，按私有处理，避免把私有 torrent 的 info hash 发到 DHT 等网络中
+var unknownDiscoveryPolicy = DiscoveryPolicy{Private: true}
+
+// Allows 判断是否允许使用 source 获取 peer
+func (p DiscoveryPolicy) Allows(source PeerSource) bool {
+	return source == PeerSourceTracker || !p.Private
+}
+
+// discoverers 返回 peerDiscoverers 中这个策略允许使用的来源
+func (p DiscoveryPolicy) discoverers() []peerDiscoverer {
+	var discoverers []peerDiscoverer
+	for _, discoverer := range peerDiscoverers {
+		if p.Allows(discoverer.Source) {
+			discoverers = append(discoverers, discoverer)
+		}
+	}
+	return discoverers
+}
+
+// peerDiscoverer 是 tracker 之外的一种 peer 来源
+// Discover 只会在 DiscoveryPolicy 允许 Source 时被调用，info 是 torrent 的 info 字典
+type peerDiscoverer struct {
+	Source   PeerSource
+	Discover func(info *InfoDict, infoHash []byte) ([]Address, error)
+}
+
+// peerDiscoverers 是已启用的 tracker 之外的 peer 来源，目前还没有实现 DHT、PEX、LSD
+// 新的来源必须注册到这里，由 requestPeers 和 Magnet.requestPeers 统一按 DiscoveryPolicy 过滤，不能自行绕过
+var peerDiscoverers []peerDiscoverer
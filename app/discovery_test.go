@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+// startTestTracker 启动一个总是返回 peer 的 HTTP tracker，返回 announce URL
+func startTestTracker(t *testing.T, peer Address) string {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		peers := []byte{127, 0, 0, 1, byte(peer.Port >> 8), byte(peer.Port)}
+		response, _ := Marshal(map[string]interface{}{"interval": 60, "peers": peers})
+		w.Write(response)
+	}))
+	t.Cleanup(server.Close)
+	return server.URL + "/announce"
+}
+
+// registerTestDiscoverers 在测试期间把 DHT、PEX、LSD 都注册为 peer 来源，返回每个来源被调用的次数
+func registerTestDiscoverers(t *testing.T, peer Address) map[PeerSource]int {
+	t.Helper()
+	saved := peerDiscoverers
+	t.Cleanup(func() { peerDiscoverers = saved })
+	calls := make(map[PeerSource]int)
+	peerDiscoverers = nil
+	for _, source := range []PeerSource{PeerSourceDHT, PeerSourcePEX, PeerSourceLSD} {
+		peerDiscoverers = append(peerDiscoverers, peerDiscoverer{
+			Source: source,
+			Discover: func(info *InfoDict, infoHash []byte) ([]Address, error) {
+				calls[source]++
+				return []Address{peer}, nil
+			},
+		})
+	}
+	return calls
+}
+
+func TestDiscoveryPolicy(t *testing.T) {
+	trackerPeer := Address{IP: "127.0.0.1", Port: 6881}
+	discoveredPeer := Address{IP: "127.0.0.1", Port: 6882}
+	announce := startTestTracker(t, trackerPeer)
+
+	root := filepath.Join(t.TempDir(), "data")
+	writeTestFiles(t, root, map[string]int{"a": 1000})
+
+	for _, private := range []bool{true, false} {
+		calls := registerTestDiscoverers(t, discoveredPeer)
+		meta, err := createTorrent(CreateOptions{Path: root, Trackers: [][]string{{announce}}, Private: private})
+		if err != nil {
+			t.Fatal(err)
+		}
+		meta, err = reparseTorrent(t, meta)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if meta.Info.Private != private {
+			t.Fatalf("private flag %v, expected %v", meta.Info.Private, private)
+		}
+		expected := []Address{trackerPeer}
+		if !private {
+			expected = append(expected, discoveredPeer)
+		}
+
+		// torrent 文件
+		peers, err := requestPeers(meta)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !slices.Equal(peers, expected) {
+			t.Fatalf("private=%v: torrent peers %v, expected %v", private, peers, expected)
+		}
+
+		// 磁力链接：获取元数据之前不知道是否私有，只使用 tracker
+		link := "magnet:?xt=urn:btih:" + hex.EncodeToString(meta.InfoHash[:]) + "&tr=" + url.QueryEscape(announce)
+		magnet, err := decodeMagnetLink(link)
+		if err != nil {
+			t.Fatal(err)
+		}
+		peers, err = magnet.requestPeers(make([]byte, 20), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !slices.Equal(peers, []Address{trackerPeer}) {
+			t.Fatalf("private=%v: magnet peers before metadata %v", private, peers)
+		}
+
+		// 磁力链接：获取元数据之后与 torrent 文件使用相同的策略
+		peers, err = getPeerAddressFromMagnet(magnet, &meta.Info)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !slices.Equal(peers, expected) {
+			t.Fatalf("private=%v: magnet peers %v, expected %v", private, peers, expected)
+		}
+
+		for _, source := range []PeerSource{PeerSourceDHT, PeerSourcePEX, PeerSourceLSD} {
+			if private && calls[source] != 0 {
+				t.Fatalf("private torrent called the %v discoverer %d times", source, calls[source])
+			}
+			if !private && calls[source] != 2 {
+				t.Fatalf("public torrent called the %v discoverer %d times, expected 2", source, calls[source])
+			}
+		}
+	}
+}
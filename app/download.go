@@ -1,13 +1,13 @@
 package main
 
 import (
+	"fmt"
+	"net"
 	"os"
-	"path/filepath"
+	"strconv"
 	"sync"
 )
 
-var PieceFilesDir = filepath.Join(os.TempDir(), "pieces")
-
 type BlockInfo struct {
 	Index  int // piece index
 	Begin  int // 字节偏移（0, 16384, 32768, ...）
@@ -19,51 +19,98 @@ type Address struct {
 	Port int
 }
 
+// String 返回 host:port 形式的地址，IPv6 地址带方括号
+func (a Address) String() string {
+	return net.JoinHostPort(a.IP, strconv.Itoa(a.Port))
+}
+
+// maxSourceRetries 是同一个来源（一个 peer 或 web seed）下载同一个 piece 最多失败的次数
+// 超过之后这个来源不再取这个 piece，其他来源仍然可以下载它
+const maxSourceRetries = 3
+
+// WorkQueue 是所有 worker（peer 和 web seed）共用的 piece 队列
+// Get 取出的 piece 在调用 Done（下载完成）或 Retry（下载失败，放回队列）之前处于进行中；
+// 队列暂时为空但还有进行中的 piece 时，Get 会等待，因为这些 piece 失败后会被放回队列，worker 不能提前退出
+// 重试次数按来源分别计算，一个 web seed 的失败不会用掉 peer 的重试次数
 type WorkQueue struct {
-	mu         sync.RWMutex
-	queue      []int       // piece索引队列
-	retryCount map[int]int // piece索引 -> 重试次数
-	maxRetries int         // 最大重试次数
+	mu       sync.Mutex
+	cond     *sync.Cond
+	queue    []int                  // piece索引队列
+	inFlight int                    // 已经取出、还没有 Done 或 Retry 的 piece 数
+	failures map[string]map[int]int // 来源 -> piece索引 -> 失败次数
 }
 
+// init 在第一次使用时初始化，调用者需要持有 wq.mu
+func (wq *WorkQueue) init() {
+	if wq.cond == nil {
+		wq.cond = sync.NewCond(&wq.mu)
+		wq.failures = make(map[string]map[int]int)
+	}
+}
+
+// Add 把 piece 加入队列（第一次加入，不计入重试次数）
 func (wq *WorkQueue) Add(piece int) {
 	wq.mu.Lock()
 	defer wq.mu.Unlock()
-	// 检查重试次数
-	if wq.retryCount == nil {
-		wq.retryCount = make(map[int]int)
-		wq.maxRetries = 3 // 默认最大重试3次
-	}
-	retryCount := wq.retryCount[piece]
-	if retryCount >= wq.maxRetries {
-		// 超过最大重试次数，不再添加
-		return
-	}
-	wq.retryCount[piece] = retryCount + 1
+	wq.init()
 	wq.queue = append(wq.queue, piece)
+	wq.cond.Broadcast()
 }
 
-// 获取队列第一个元素并推出
-func (wq *WorkQueue) Get() (int, bool) {
+// Get 为 source 取出队列中第一个它还可以下载的 piece
+// 没有可以下载的 piece 但还有进行中的 piece 时等待；没有进行中的 piece 时返回 false，worker 应该退出
+func (wq *WorkQueue) Get(source string) (int, bool) {
 	wq.mu.Lock()
 	defer wq.mu.Unlock()
-	if len(wq.queue) == 0 {
-		return 0, false
+	wq.init()
+	for {
+		for i, piece := range wq.queue {
+			if wq.failures[source][piece] >= maxSourceRetries {
+				continue
+			}
+			wq.queue = append(wq.queue[:i:i], wq.queue[i+1:]...)
+			wq.inFlight++
+			return piece, true
+		}
+		if wq.inFlight == 0 {
+			return 0, false
+		}
+		wq.cond.Wait()
 	}
-	piece := wq.queue[0]
-	wq.queue = wq.queue[1:]
-	return piece, true
+}
+
+// Done 表示 Get 取出的 piece 已经处理完（下载成功，或者已经由其他 worker 下载）
+func (wq *WorkQueue) Done(piece int) {
+	wq.mu.Lock()
+	defer wq.mu.Unlock()
+	wq.init()
+	wq.inFlight--
+	wq.cond.Broadcast()
+}
+
+// Retry 表示 source 下载 piece 失败：记录这个来源的失败次数，把 piece 放回队列由这个或其他来源重试
+func (wq *WorkQueue) Retry(source string, piece int) {
+	wq.mu.Lock()
+	defer wq.mu.Unlock()
+	wq.init()
+	if wq.failures[source] == nil {
+		wq.failures[source] = make(map[int]int)
+	}
+	wq.failures[source][piece]++
+	wq.queue = append(wq.queue, piece)
+	wq.inFlight--
+	wq.cond.Broadcast()
 }
 
 func (wq *WorkQueue) IsEmpty() bool {
-	wq.mu.RLock()
-	defer wq.mu.RUnlock()
+	wq.mu.Lock()
+	defer wq.mu.Unlock()
 	return len(wq.queue) == 0
 }
 
 func (wq *WorkQueue) Size() int {
-	wq.mu.RLock()
-	defer wq.mu.RUnlock()
+	wq.mu.Lock()
+	defer wq.mu.Unlock()
 	return len(wq.queue)
 }
 
@@ -97,3 +144,77 @@ func (pb *PieceBuffer) Size() int {
 	defer pb.mu.RUnlock()
 	return len(pb.pieces)
 }
+
+// pieceWorker 通过一个 peer 从共享的队列中取 piece 下载，直到 WorkQueue.Get 返回 false 或连接出错
+// 取出的每个 piece 都必须调用 Done 或 Retry，否则其他 worker 会一直等待
+type pieceWorker func(peer Address, queue *WorkQueue, buffer *PieceBuffer) error
+
+// downloadToPath 是所有下载命令共用的流程：先根据文件布局确定输出路径，元数据中不安全的路径在下载之前就会被拒绝；
+// 然后调用 download 获取所有 piece（连接 tracker 和 peer 都在这一步），最后按文件布局写出
+// （多文件 torrent 会创建目录结构，跨文件的 piece 会被拆分）
+func downloadToPath(info *InfoDict, savePath string, download func() (map[int][]byte, error)) error {
+	storage, err := newFileStorage(info, savePath)
+	if err != nil {
+		return err
+	}
+	pieces, err := download()
+	if err != nil {
+		return err
+	}
+	err = storage.WritePieces(pieces)
+	if err != nil {
+		return fmt.Errorf("error writing files: %v", err)
+	}
+	return nil
+}
+
+// downloadAllPieces 为每个 peer 和 web seed 各启动一个 worker，共用同一个工作队列下载 info 的所有 piece
+// 单个 worker 出错只记录下来，不中断其他 worker；最后有 piece 没有下载到时返回错误
+func downloadAllPieces(info *InfoDict, peers []Address, webSeeds []string, worker pieceWorker) (map[int][]byte, error) {
+	piecesLen := info.NumPieces()
+
+	// 初始化工作队列
+	queue := &WorkQueue{}
+	for i := 0; i < piecesLen; i++ {
+		queue.Add(i)
+	}
+
+	// 初始化 piece 缓冲区
+	buffer := &PieceBuffer{
+		pieces: make(map[int][]byte),
+	}
+
+	// 启动多个 worker goroutines
+	var wg sync.WaitGroup
+	for _, peer := range peers {
+		wg.Add(1)
+		go func(peer Address) {
+			defer wg.Done()
+			err := worker(peer, queue, buffer)
+			if err != nil {
+				// 记录错误但不中断其他 workers
+				fmt.Fprintf(os.Stderr, "Worker error with peer %s:%d: %v\n", peer.IP, peer.Port, err)
+			}
+		}(peer)
+	}
+	for _, webSeedURL := range webSeeds {
+		wg.Add(1)
+		go func(webSeed *WebSeed) {
+			defer wg.Done()
+			err := downloadPiecesFromWebSeed(webSeed, info, queue, buffer)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Worker error with web seed %s: %v\n", webSeed.URL, err)
+			}
+		}(&WebSeed{URL: webSeedURL, Client: webSeedHTTPClient})
+	}
+
+	// 等待所有 workers 完成
+	wg.Wait()
+
+	// 检查是否所有 pieces 都已下载
+	if !buffer.HasAll(piecesLen) {
+		downloaded := buffer.Size()
+		return nil, fmt.Errorf("not all pieces downloaded: %d/%d pieces downloaded", downloaded, piecesLen)
+	}
+	return buffer.pieces, nil
+}
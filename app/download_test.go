@@ -0,0 +1,78 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestWorkQueueRetryBudgetPerSource(t *testing.T) {
+	queue := &WorkQueue{}
+	queue.Add(0)
+	// 第一次加入不算重试，同一个来源可以失败 maxSourceRetries 次
+	for i := 0; i < maxSourceRetries; i++ {
+		piece, ok := queue.Get("web seed")
+		if !ok || piece != 0 {
+			t.Fatalf("attempt %d: got %d, %v", i+1, piece, ok)
+		}
+		queue.Retry("web seed", piece)
+	}
+	if _, ok := queue.Get("web seed"); ok {
+		t.Fatal("source exceeded its retry budget")
+	}
+	// 其他来源的重试次数不受影响
+	piece, ok := queue.Get("peer")
+	if !ok || piece != 0 {
+		t.Fatalf("peer: got %d, %v", piece, ok)
+	}
+	queue.Done(piece)
+	if _, ok := queue.Get("peer"); ok {
+		t.Fatal("expected the queue to be finished")
+	}
+}
+
+// 队列暂时为空时，worker 要等其他 worker 手上的 piece 完成，失败放回队列的 piece 由它接着下载
+func TestWorkQueueWaitsForInFlightPieces(t *testing.T) {
+	queue := &WorkQueue{}
+	queue.Add(0)
+	queue.Add(1)
+	first, _ := queue.Get("a")
+	second, _ := queue.Get("a")
+
+	type result struct {
+		piece int
+		ok    bool
+	}
+	results := make(chan result, 1)
+	go func() {
+		piece, ok := queue.Get("b")
+		results <- result{piece, ok}
+	}()
+	select {
+	case r := <-results:
+		t.Fatalf("worker did not wait for in-flight pieces: got %d, %v", r.piece, r.ok)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	queue.Done(first)
+	queue.Retry("a", second)
+	r := <-results
+	if !r.ok || r.piece != second {
+		t.Fatalf("expected the re-queued piece %d, got %d, %v", second, r.piece, r.ok)
+	}
+
+	// 最后一个进行中的 piece 完成后，等待的 worker 退出
+	go func() {
+		piece, ok := queue.Get("c")
+		results <- result{piece, ok}
+	}()
+	time.Sleep(10 * time.Millisecond)
+	queue.Done(r.piece)
+	select {
+	case r := <-results:
+		if r.ok {
+			t.Fatalf("expected no more pieces, got %d", r.piece)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("worker kept waiting after all pieces were done")
+	}
+}
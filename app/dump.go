@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// dumpPreviewLimit 是 dump 输出中字符串预览的最大字节数，超过的部分会被截断
+const dumpPreviewLimit = 48
+
+// dumpBencode 把解码得到的节点树逐行写到 w 中，用于排查 info 命令拒绝的文件或者奇怪的扩展消息
+// 每一行包括节点类型、在输入中的字节偏移、占用的字节数和值的预览，
+// 宽松模式下接受的非规范写法会在对应节点下面以 "!" 开头单独列出
+// binaryMode 决定二进制字符串的预览格式（"hex" 或 "base64"）
+func dumpBencode(w io.Writer, root *BencodeNode, binaryMode string) {
+	dumpBencodeNode(w, root, "", 0, binaryMode)
+}
+
+func dumpBencodeNode(w io.Writer, node *BencodeNode, label string, indent int, binaryMode string) {
+	prefix := strings.Repeat("  ", indent)
+	header := fmt.Sprintf("%s%s%s @%d len=%d", prefix, label, kindName(node.Kind), node.Offset, node.Length())
+
+	switch node.Kind {
+	case 's':
+		fmt.Fprintf(w, "%s: %s\n", header, dumpStringPreview(node.Value.(string), binaryMode))
+	case 'i':
+		fmt.Fprintf(w, "%s: %v\n", header, node.Value)
+	case 'l':
+		fmt.Fprintf(w, "%s (%d items)\n", header, len(node.List))
+	case 'd':
+		fmt.Fprintf(w, "%s (%d keys)\n", header, len(node.Keys))
+	}
+
+	for _, issue := range node.Issues {
+		fmt.Fprintf(w, "%s  ! non-canonical at offset %d: %s\n", prefix, issue.Offset, issue.Reason)
+	}
+
+	switch node.Kind {
+	case 'l':
+		for i, child := range node.List {
+			dumpBencodeNode(w, child, fmt.Sprintf("[%d] ", i), indent+1, binaryMode)
+		}
+	case 'd':
+		// 按输入中的顺序输出，这样乱序的键也能一眼看出来
+		for _, key := range node.Keys {
+			label := dumpStringPreview(key, binaryMode) + " => "
+			dumpBencodeNode(w, node.Dict[key], label, indent+1, binaryMode)
+		}
+	}
+}
+
+// dumpStringPreview 生成字符串的预览
+// 可打印的 UTF-8 文本带引号输出，其余的按 binaryMode 编码输出，都只保留前 dumpPreviewLimit 个字节
+func dumpStringPreview(s string, binaryMode string) string {
+	truncated := ""
+	preview := s
+	if len(preview) > dumpPreviewLimit {
+		preview = preview[:dumpPreviewLimit]
+		truncated = fmt.Sprintf("... (%d bytes)", len(s))
+	}
+
+	if isPrintableText(s) {
+		// 截断位置可能落在多字节字符中间，退回到完整字符的边界
+		for len(preview) > 0 && !utf8.ValidString(preview) {
+			preview = preview[:len(preview)-1]
+		}
+		return fmt.Sprintf("%q%s", preview, truncated)
+	}
+	if binaryMode == "base64" {
+		return "base64:" + base64.StdEncoding.EncodeToString([]byte(preview)) + truncated
+	}
+	return "hex:" + hex.EncodeToString([]byte(preview)) + truncated
+}
+
+// isPrintableText 判断字符串是否是可以直接显示的文本
+func isPrintableText(s string) bool {
+	if !utf8.ValidString(s) {
+		return false
+	}
+	for _, r := range s {
+		if !unicode.IsPrint(r) && r != '\n' && r != '\t' {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// EditOptions 是 edit 命令的参数，没有指定的键保持不变
+type EditOptions struct {
+	TorrentFile   string
+	Trackers      [][]string // 非空时替换 announce 和 announce-list，规则与 create 相同
+	ClearTrackers bool       // 删除 announce 和 announce-list
+	WebSeeds      []string   // 追加到 url-list
+	ClearWebSeeds bool       // 先清空 url-list
+	Comment       *string    // 空字符串表示删除 comment
+	CreatedBy     *string    // 空字符串表示删除 created by
+	OutputPath    string     // 为空时原地修改
+}
+
+// parseEditArgs 解析 edit 命令的参数
+// edit [--tracker <url>[,<url>...]]... [--clear-trackers] [--web-seed <url>]... [--clear-web-seeds]
+// [--comment <text>] [--created-by <text>] [-o <output>] <torrent_file>
+func parseEditArgs(args []string) (EditOptions, error) {
+	var opts EditOptions
+	var trackerArgs []string
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		switch arg {
+		case "--tracker", "-t", "--web-seed", "-w", "--comment", "--created-by", "-o", "--output":
+			if i+1 >= len(args) {
+				return opts, fmt.Errorf("%s requires a value", arg)
+			}
+			i++
+			value := args[i]
+			switch arg {
+			case "--tracker", "-t":
+				trackerArgs = append(trackerArgs, value)
+			case "--web-seed", "-w":
+				opts.WebSeeds = append(opts.WebSeeds, value)
+			case "--comment":
+				opts.Comment = &value
+			case "--created-by":
+				opts.CreatedBy = &value
+			default:
+				opts.OutputPath = value
+			}
+		case "--clear-trackers":
+			opts.ClearTrackers = true
+		case "--clear-web-seeds":
+			opts.ClearWebSeeds = true
+		default:
+			if strings.HasPrefix(arg, "-") && arg != "-" {
+				return opts, fmt.Errorf("unknown option %s", arg)
+			}
+			if opts.TorrentFile != "" {
+				return opts, fmt.Errorf("unexpected argument %s", arg)
+			}
+			opts.TorrentFile = arg
+		}
+	}
+	opts.Trackers = parseTrackerTiers(trackerArgs)
+	if opts.TorrentFile == "" {
+		return opts, errors.New("usage: edit [--tracker <url>] [--clear-trackers] [--web-seed <url>] [--clear-web-seeds] [--comment <text>] [--created-by <text>] [-o <output>] <torrent_file>")
+	}
+	return opts, nil
+}
+
+// editTorrent 按 opts 修改 torrent 的顶层键，返回新的 torrent 文件内容和重新解析得到的 Metainfo
+// 只重新编码被修改的键，其他顶层键（包括 info 和未知的键）都原样使用文件中的原始字节，
+// 因此 info hash 不会改变；编码后会重新解析一遍确认这一点
+func editTorrent(data []byte, opts EditOptions) ([]byte, *Metainfo, error) {
+	node, err := decodeBencodeBytes(data, BencodeLenient)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error decoding bencoded string: %v", err)
+	}
+	before, err := parseMetainfo(node)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	entries := make(map[string]RawBencode, len(node.Keys))
+	for _, key := range node.Keys {
+		entries[key] = node.Dict[key].Raw
+	}
+	set := func(key string, value interface{}) error {
+		encoded, err := Marshal(value)
+		if err != nil {
+			return fmt.Errorf("error encoding %s: %v", key, err)
+		}
+		entries[key] = encoded
+		return nil
+	}
+
+	if opts.ClearTrackers {
+		delete(entries, "announce")
+		delete(entries, "announce-list")
+	}
+	if len(opts.Trackers) > 0 {
+		err = set("announce", opts.Trackers[0][0])
+		if err != nil {
+			return nil, nil, err
+		}
+		// 只有一个 tracker 时不需要 announce-list，原有的 announce-list 也要删除，否则它会优先于 announce
+		delete(entries, "announce-list")
+		if len(opts.Trackers) > 1 || len(opts.Trackers[0]) > 1 {
+			err = set("announce-list", opts.Trackers)
+			if err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+
+	if opts.ClearWebSeeds || len(opts.WebSeeds) > 0 {
+		var webSeeds []string
+		if !opts.ClearWebSeeds {
+			webSeeds = append(webSeeds, before.WebSeeds...)
+		}
+		for _, webSeed := range opts.WebSeeds {
+			if !slices.Contains(webSeeds, webSeed) {
+				webSeeds = append(webSeeds, webSeed)
+			}
+		}
+		delete(entries, "url-list")
+		if len(webSeeds) > 0 {
+			err = set("url-list", webSeeds)
+			if err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+
+	textKeys := []struct {
+		key   string
+		value *string
+	}{
+		{"comment", opts.Comment},
+		{"created by", opts.CreatedBy},
+	}
+	for _, text := range textKeys {
+		if text.value == nil {
+			continue
+		}
+		delete(entries, text.key)
+		if *text.value != "" {
+			err = set(text.key, *text.value)
+			if err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+
+	encoded, err := Marshal(entries)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error encoding torrent: %v", err)
+	}
+	node, err = decodeBencodeBytes(encoded, BencodeLenient)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error decoding edited torrent: %v", err)
+	}
+	after, err := parseMetainfo(node)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !bytes.Equal(after.InfoBytes, before.InfoBytes) || after.InfoHash != before.InfoHash || after.InfoHashV2 != before.InfoHashV2 {
+		return nil, nil, errors.New("error: info hash changed while editing, torrent not written")
+	}
+	return encoded, after, nil
+}
+
+// edit 实现 edit 命令，返回要输出的信息
+func edit(opts EditOptions) (string, error) {
+	data, err := os.ReadFile(opts.TorrentFile)
+	if err != nil {
+		return "", fmt.Errorf("error reading file: %v", err)
+	}
+	encoded, after, err := editTorrent(data, opts)
+	if err != nil {
+		return "", err
+	}
+
+	outputPath := opts.OutputPath
+	if outputPath == "" {
+		outputPath = opts.TorrentFile
+	}
+	// 先写到同一目录下的临时文件再重命名，原地修改时中途失败不会损坏原文件
+	temp, err := os.CreateTemp(filepath.Dir(outputPath), ".edit-*.torrent")
+	if err != nil {
+		return "", fmt.Errorf("error writing torrent file: %v", err)
+	}
+	_, err = temp.Write(encoded)
+	if closeErr := temp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(temp.Name(), 0644)
+	}
+	if err == nil {
+		err = os.Rename(temp.Name(), outputPath)
+	}
+	if err != nil {
+		os.Remove(temp.Name())
+		return "", fmt.Errorf("error writing torrent file: %v", err)
+	}
+
+	response := fmt.Sprintf("Edited: %s", outputPath)
+	if after.Info.HasV1() {
+		response += fmt.Sprintf("\nInfo Hash: %x (unchanged)", after.InfoHash)
+	}
+	if after.Info.IsV2() {
+		response += fmt.Sprintf("\nInfo Hash v2: %x (unchanged)", after.InfoHashV2)
+	}
+	return response, nil
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// 非规范的 torrent：info 字典的键没有排序、带有未知的键，顶层的键也没有排序并带有未知的键
+func unusualTorrentForTest() (torrent []byte, info []byte) {
+	info = []byte("d2:zzi1e6:lengthi5e4:name1:a12:piece lengthi16384e6:pieces20:" + strings.Repeat("\x01", 20) + "e")
+	torrent = slices.Concat(
+		[]byte("d4:info"), info,
+		[]byte("8:announce17:http://a/announce7:unknownl1:x1:ye13:creation datei1e7:comment3:olde"),
+	)
+	return torrent, info
+}
+
+func TestEditKeepsInfoBytes(t *testing.T) {
+	torrent, info := unusualTorrentForTest()
+	comment, createdBy := "", "editor"
+	opts := EditOptions{
+		Trackers:  [][]string{{"http://b/announce", "http://c/announce"}, {"http://d/announce"}},
+		WebSeeds:  []string{"http://seed/"},
+		Comment:   &comment,
+		CreatedBy: &createdBy,
+	}
+	encoded, after, err := editTorrent(torrent, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(after.InfoBytes, info) || after.InfoHash != sha1.Sum(info) {
+		t.Fatalf("info changed: %q", after.InfoBytes)
+	}
+	if !bytes.Contains(encoded, slices.Concat([]byte("4:info"), info)) {
+		t.Fatal("info bytes were re-encoded")
+	}
+	if !bytes.Contains(encoded, []byte("7:unknownl1:x1:ye")) || !bytes.Contains(encoded, []byte("13:creation datei1e")) {
+		t.Fatalf("unknown or untouched keys were lost: %q", encoded)
+	}
+	if bytes.Contains(encoded, []byte("7:comment")) {
+		t.Fatal("empty comment should remove the key")
+	}
+	if after.Announce != "http://b/announce" || !slices.EqualFunc(after.AnnounceList, opts.Trackers, slices.Equal) ||
+		after.CreatedBy != "editor" || !slices.Equal(after.WebSeeds, []string{"http://seed/"}) {
+		t.Fatalf("edited keys: %+v", after)
+	}
+	// 顶层的键按规范顺序写出，同样的编辑得到同样的字节
+	node, err := decodeBencodeBytes(encoded, BencodeLenient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.IsSorted(node.Keys) {
+		t.Fatalf("top-level keys not sorted: %q", node.Keys)
+	}
+	again, _, err := editTorrent(torrent, opts)
+	if err != nil || !bytes.Equal(again, encoded) {
+		t.Fatal("editing twice gave different bytes")
+	}
+
+	// edit 命令写出的文件，重新加载后 info hash 不变
+	dir := t.TempDir()
+	input := filepath.Join(dir, "in.torrent")
+	if err := os.WriteFile(input, torrent, 0644); err != nil {
+		t.Fatal(err)
+	}
+	output := filepath.Join(dir, "out.torrent")
+	if _, err := edit(EditOptions{TorrentFile: input, OutputPath: output, ClearTrackers: true}); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := loadMetainfo(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(loaded.InfoBytes, info) || loaded.InfoHash != sha1.Sum(info) || loaded.Announce != "" {
+		t.Fatalf("loaded torrent: info %q, announce %q", loaded.InfoBytes, loaded.Announce)
+	}
+	if original, _ := os.ReadFile(input); !bytes.Equal(original, torrent) {
+		t.Fatal("input file changed when writing to another path")
+	}
+}
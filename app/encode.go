@@ -3,17 +3,30 @@ package main
 import (
 	"errors"
 	"fmt"
+	"math/big"
 	"sort"
 )
 
 func encodeBencode(value interface{}) (string, error) {
 	switch v := value.(type) {
-	case int:
+	case int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64:
 		return fmt.Sprintf("i%de", v), nil
+	case *big.Int:
+		// 超出 64 位范围的整数
+		if v == nil {
+			return "", errors.New("invalid value type: nil *big.Int")
+		}
+		return "i" + v.String() + "e", nil
 	case string:
 		return fmt.Sprintf("%d:%s", len(v), v), nil
 	case []byte:
 		return fmt.Sprintf("%d:", len(v)) + string(v), nil
+	case RawBencode:
+		// 已经是编码好的值，原样写出
+		if len(v) == 0 {
+			return "", errEmptyRawBencode
+		}
+		return string(v), nil
 	case []interface{}:
 		var result string = "l"
 		for _, item := range v {
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"strings"
+	"unicode/utf8"
+)
+
+// JSON 中表示二进制字符串的转义约定：{"$hex": "..."} 或 {"$base64": "..."}
+// 这样 piece 哈希、紧凑格式的 peers 等二进制值可以被精确地写出
+// JSON 对象的键只能是字符串，二进制的字典键（例如 piece layers 的键）写成 "$hex:..." 或 "$base64:..."
+const (
+	jsonHexKey          = "$hex"
+	jsonBase64Key       = "$base64"
+	jsonHexKeyPrefix    = jsonHexKey + ":"
+	jsonBase64KeyPrefix = jsonBase64Key + ":"
+)
+
+// bencodeToJSONValue 把解码后的 bencode 值转换为可以无损输出为 JSON 的值
+// 合法的 UTF-8 字符串原样输出，二进制字符串按 binaryMode（"hex" 或 "base64"）
+// 转义为 {"$hex": "..."} / {"$base64": "..."}，与 encode 命令的输入约定一致，可以原样编码回去
+func bencodeToJSONValue(value interface{}, binaryMode string) interface{} {
+	switch v := value.(type) {
+	case string:
+		if utf8.ValidString(v) {
+			return v
+		}
+		if binaryMode == "base64" {
+			return map[string]string{jsonBase64Key: base64.StdEncoding.EncodeToString([]byte(v))}
+		}
+		return map[string]string{jsonHexKey: hex.EncodeToString([]byte(v))}
+	case []interface{}:
+		list := make([]interface{}, 0, len(v))
+		for _, item := range v {
+			list = append(list, bencodeToJSONValue(item, binaryMode))
+		}
+		return list
+	case map[string]interface{}:
+		dict := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			dict[bencodeKeyToJSON(key, binaryMode)] = bencodeToJSONValue(item, binaryMode)
+		}
+		return dict
+	case *big.Int:
+		// 直接输出数字本身，避免丢失精度
+		return json.Number(v.String())
+	default:
+		return v
+	}
+}
+
+// bencodeKeyToJSON 转换字典键：合法的 UTF-8 键原样输出，二进制键按 binaryMode 转义为 "$hex:..." / "$base64:..."
+// 本身就是 "$hex"、"$base64" 或以转义前缀开头的键也要转义，否则 encode 时会被当成转义
+func bencodeKeyToJSON(key string, binaryMode string) string {
+	reserved := key == jsonHexKey || key == jsonBase64Key ||
+		strings.HasPrefix(key, jsonHexKeyPrefix) || strings.HasPrefix(key, jsonBase64KeyPrefix)
+	if utf8.ValidString(key) && !reserved {
+		return key
+	}
+	if binaryMode == "base64" {
+		return jsonBase64KeyPrefix + base64.StdEncoding.EncodeToString([]byte(key))
+	}
+	return jsonHexKeyPrefix + hex.EncodeToString([]byte(key))
+}
+
+// jsonKeyToBencode 是 bencodeKeyToJSON 的逆过程，还原 "$hex:..." / "$base64:..." 形式的键
+func jsonKeyToBencode(key string, where string) (string, error) {
+	var data []byte
+	var err error
+	switch {
+	case strings.HasPrefix(key, jsonHexKeyPrefix):
+		data, err = hex.DecodeString(strings.TrimPrefix(key, jsonHexKeyPrefix))
+	case strings.HasPrefix(key, jsonBase64KeyPrefix):
+		data, err = base64.StdEncoding.DecodeString(strings.TrimPrefix(key, jsonBase64KeyPrefix))
+	default:
+		return key, nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("%s: invalid escaped key %q: %v", where, key, err)
+	}
+	return string(data), nil
+}
+
+// readJSONValue 从 r 读取恰好一个 JSON 值，数字保留为 json.Number 以免丢失精度
+func readJSONValue(r io.Reader) (interface{}, error) {
+	decoder := json.NewDecoder(r)
+	decoder.UseNumber()
+	var value interface{}
+	err := decoder.Decode(&value)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing JSON: %v", err)
+	}
+	if decoder.More() {
+		return nil, errors.New("error parsing JSON: unexpected data after top-level value")
+	}
+	return value, nil
+}
+
+// jsonToBencodeValue 把 JSON 值转换为 encodeBencode 能处理的值
+// path 用于在错误信息中指出出错的位置
+func jsonToBencodeValue(value interface{}, path string) (interface{}, error) {
+	where := path
+	if where == "" {
+		where = "top-level value"
+	}
+	switch v := value.(type) {
+	case string:
+		return v, nil
+	case json.Number:
+		n, err := v.Int64()
+		if err == nil {
+			return n, nil
+		}
+		// 超出 int64 范围的整数按任意精度编码
+		bigValue, ok := new(big.Int).SetString(v.String(), 10)
+		if !ok {
+			return nil, fmt.Errorf("%s: bencode only supports integers, got %s", where, v.String())
+		}
+		return bigValue, nil
+	case []interface{}:
+		list := make([]interface{}, 0, len(v))
+		for i, item := range v {
+			converted, err := jsonToBencodeValue(item, fmt.Sprintf("%s[%d]", path, i))
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, converted)
+		}
+		return list, nil
+	case map[string]interface{}:
+		if binary, ok, err := decodeJSONBinary(v, where); ok || err != nil {
+			return binary, err
+		}
+		dict := make(map[string]interface{}, len(v))
+		for jsonKey, item := range v {
+			key, err := jsonKeyToBencode(jsonKey, where)
+			if err != nil {
+				return nil, err
+			}
+			if _, exists := dict[key]; exists {
+				return nil, fmt.Errorf("%s: duplicate key %q", where, key)
+			}
+			converted, err := jsonToBencodeValue(item, joinFieldPath(path, jsonKey))
+			if err != nil {
+				return nil, err
+			}
+			dict[key] = converted
+		}
+		return dict, nil
+	case bool:
+		return nil, fmt.Errorf("%s: bencode has no boolean type, use 0 or 1", where)
+	case nil:
+		return nil, fmt.Errorf("%s: bencode has no null value", where)
+	default:
+		return nil, fmt.Errorf("%s: unsupported JSON value %T", where, value)
+	}
+}
+
+// decodeJSONBinary 识别 {"$hex": "..."} / {"$base64": "..."} 形式的二进制字符串
+// 第二个返回值表示该对象是否是二进制转义
+func decodeJSONBinary(obj map[string]interface{}, where string) ([]byte, bool, error) {
+	if len(obj) != 1 {
+		return nil, false, nil
+	}
+	for key, item := range obj {
+		if key != jsonHexKey && key != jsonBase64Key {
+			return nil, false, nil
+		}
+		str, ok := item.(string)
+		if !ok {
+			return nil, true, fmt.Errorf("%s: %q value must be a string", where, key)
+		}
+		var data []byte
+		var err error
+		if key == jsonHexKey {
+			data, err = hex.DecodeString(strings.TrimSpace(str))
+		} else {
+			data, err = base64.StdEncoding.DecodeString(strings.TrimSpace(str))
+		}
+		if err != nil {
+			return nil, true, fmt.Errorf("%s: invalid %q value: %v", where, key, err)
+		}
+		return data, true, nil
+	}
+	return nil, false, nil
+}
+
+// encodeJSONToBencode 实现 encode 命令：读取一个 JSON 值并编码为 bencode
+func encodeJSONToBencode(r io.Reader) (string, error) {
+	value, err := readJSONValue(r)
+	if err != nil {
+		return "", err
+	}
+	converted, err := jsonToBencodeValue(value, "")
+	if err != nil {
+		return "", err
+	}
+	return encodeBencode(converted)
+}
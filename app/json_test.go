@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// decodeToJSON 与 decode 命令相同：解码 bencode 后转换为 JSON
+func decodeToJSON(t *testing.T, data []byte, binaryMode string) []byte {
+	t.Helper()
+	node, err := decodeBencodeBytes(data, BencodeStrict)
+	if err != nil {
+		t.Fatal(err)
+	}
+	output, err := json.Marshal(bencodeToJSONValue(node.Value, binaryMode))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return output
+}
+
+// decode 的输出交给 encode 后必须得到原来的字节，包括二进制的字典键和看起来像转义的键
+func TestJSONRoundTrip(t *testing.T) {
+	root := filepath.Join(t.TempDir(), "v2")
+	writeTestFiles(t, root, map[string]int{"a": 100000, "b": 40000})
+	meta, err := createTorrent(CreateOptions{Path: root, PieceLength: 16384, Hybrid: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(meta.PieceLayers) == 0 {
+		t.Fatal("expected piece layers")
+	}
+	torrent, err := Marshal(meta)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	inputs := map[string]string{
+		"torrent with piece layers": string(torrent),
+		"binary keys":               "d3:\x00\xff\x01i1e2:\xc3\x28l3:\x80\x81\x82ee",
+		"reserved keys":             "d7:$base644:\xff\xfe\xfd\xfc8:$base64:0:4:$hexi1e5:$hex:2:abe",
+		"reserved key alone":        "d4:$hex2:abe",
+		"nested":                    "ld1:ad1:\xffd4:$hexd0:0:eeeee",
+	}
+	for name, input := range inputs {
+		for _, binaryMode := range []string{"hex", "base64"} {
+			output := decodeToJSON(t, []byte(input), binaryMode)
+			if !json.Valid(output) || bytes.Contains(output, []byte(`\ufffd`)) {
+				t.Fatalf("%s (%s): invalid JSON output %s", name, binaryMode, output)
+			}
+			encoded, err := encodeJSONToBencode(bytes.NewReader(output))
+			if err != nil {
+				t.Fatalf("%s (%s): %v", name, binaryMode, err)
+			}
+			if encoded != input {
+				t.Fatalf("%s (%s): round trip gave %q, expected %q", name, binaryMode, encoded, input)
+			}
+		}
+	}
+
+	// 写回的文件仍然是同一个 torrent
+	path := filepath.Join(t.TempDir(), "round-trip.torrent")
+	encoded, _ := encodeJSONToBencode(bytes.NewReader(decodeToJSON(t, torrent, "hex")))
+	if err := os.WriteFile(path, []byte(encoded), 0644); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := loadMetainfoWithMode(path, BencodeStrict)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.InfoHashV2 != meta.InfoHashV2 || len(loaded.PieceLayers) != len(meta.PieceLayers) {
+		t.Fatal("round-tripped torrent differs")
+	}
+}
+
+func TestEncodeEscapedKeyErrors(t *testing.T) {
+	tests := map[string]string{
+		`{"$hex:zz": 1}`:             "invalid escaped key",
+		`{"$base64:!!": 1}`:          "invalid escaped key",
+		`{"a": 1, "$hex:61": 2}`:     "duplicate key",
+		`{"x": {"$hex:": 1, "": 2}}`: "duplicate key",
+	}
+	for input, expected := range tests {
+		_, err := encodeJSONToBencode(strings.NewReader(input))
+		if err == nil || !strings.Contains(err.Error(), expected) {
+			t.Fatalf("%s: expected %q error, got %v", input, expected, err)
+		}
+	}
+}
+
+func TestParseDecodeArgs(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "a.torrent")
+	if err := os.WriteFile(path, []byte("i1e"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// 只能有一个输入来源
+	for _, args := range [][]string{
+		{"--file", path, "--file", path},
+		{"--file", path, "i1e"},
+		{"i1e", "-f", path},
+		{"i1e", "i2e"},
+		{"-", "i1e"},
+		{"--binary=base64", "-", "--file", path},
+	} {
+		input, _, err := parseDecodeArgs(args)
+		if err == nil || !strings.Contains(err.Error(), "only one input") {
+			t.Fatalf("%q: expected an error, got input %v, %v", args, input, err)
+		}
+	}
+
+	input, binaryMode, err := parseDecodeArgs([]string{"--binary=base64", "--file", path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	file, ok := input.(*os.File)
+	if !ok || file.Name() != path || binaryMode != "base64" {
+		t.Fatalf("got input %v, binary mode %q", input, binaryMode)
+	}
+	file.Close()
+	if input, _, err := parseDecodeArgs(nil); err != nil || input != os.Stdin {
+		t.Fatalf("expected standard input, got %v, %v", input, err)
+	}
+	input, _, err = parseDecodeArgs([]string{"4:spam"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := io.ReadAll(input); string(data) != "4:spam" {
+		t.Fatalf("got %q", data)
+	}
+}
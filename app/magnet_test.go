@@ -0,0 +1,271 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testPeer 是本地的 peer：用 metadataConn 回应 ut_metadata 请求，
+// 有 layers 时按 BEP 52 回应 hash request，否则回复 hash reject；收到 interested 后 unchoke，从 pieces 回应 request
+// v2 为 true 时是 v2 torrent 的 peer：握手中没有设置 v2 协议位的连接直接关闭
+type testPeer struct {
+	metadata []byte
+	layers   map[string][]byte // pieces root -> piece 层（连接在一起的哈希），不含补齐部分
+	pad      [32]byte
+	pieces   [][]byte
+	v2       bool
+
+	silent           bool          // 完成握手后不回应任何请求，只不停地发送 keep-alive
+	delay            time.Duration // 回应每个 ut_metadata 请求之前等待的时间
+	metadataRequests atomic.Int32  // 收到的 ut_metadata 请求数
+}
+
+// start 在本地端口上监听，返回可以放进磁力链接 x.pe 的地址
+func (p *testPeer) start(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go p.serve(conn)
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func (p *testPeer) serve(rawConn net.Conn) {
+	defer rawConn.Close()
+	handshake := make([]byte, 68)
+	if _, err := io.ReadFull(rawConn, handshake); err != nil {
+		return
+	}
+	if p.v2 && handshake[27]&0x10 == 0 {
+		return
+	}
+	reply := append([]byte{19}, "BitTorrent protocol"...)
+	reply = append(reply, handshakeReserved(true, p.v2)...)
+	reply = append(reply, handshake[28:48]...)
+	reply = append(reply, "-TEST00-000000000000"...)
+	rawConn.Write(reply)
+	rawConn.Write(buildPeerMessage(5, []byte{0xff}))
+	extensionHandshakeMsg, _ := buildExtensionHandshakeMessage(ourMetadataExtensionID, int64(len(p.metadata)))
+	rawConn.Write(extensionHandshakeMsg)
+	for p.silent {
+		if _, err := rawConn.Write([]byte{0, 0, 0, 0}); err != nil {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	conn := newMetadataConn(rawConn, p.metadata)
+	for {
+		messageID, payload, err := readRawPeerMessage(conn)
+		if err != nil {
+			return
+		}
+		switch messageID {
+		case 20:
+			if len(payload) > 0 && payload[0] == ourMetadataExtensionID {
+				p.metadataRequests.Add(1)
+				time.Sleep(p.delay)
+			}
+			if _, err := conn.handleExtensionMessage(payload); err != nil {
+				return
+			}
+			continue
+		case 2:
+			conn.Write(buildPeerMessage(1, nil))
+			continue
+		case 6:
+			if len(payload) != 12 {
+				return
+			}
+			index := binary.BigEndian.Uint32(payload[0:4])
+			begin := binary.BigEndian.Uint32(payload[4:8])
+			length := binary.BigEndian.Uint32(payload[8:12])
+			if int(index) >= len(p.pieces) || int(begin+length) > len(p.pieces[index]) {
+				return
+			}
+			conn.Write(buildPeerMessage(7, append(bytes.Clone(payload[:8]), p.pieces[index][begin:begin+length]...)))
+			continue
+		case msgHashRequest:
+		default:
+			continue
+		}
+		request, _, err := parseHashRequest(payload)
+		if err != nil {
+			return
+		}
+		layer, ok := p.layers[string(request.PiecesRoot[:])]
+		if !ok {
+			conn.Write(buildPeerMessage(msgHashReject, request.encode()))
+			continue
+		}
+		hashes := request.encode()
+		for i := request.Index; i < request.Index+request.Length; i++ {
+			if int(i)*32 < len(layer) {
+				hashes = append(hashes, layer[i*32:i*32+32]...)
+			} else {
+				hashes = append(hashes, p.pad[:]...)
+			}
+		}
+		conn.Write(buildPeerMessage(msgHashes, hashes))
+	}
+}
+
+// createHybridForTest 生成一个混合 torrent，其中有长度超过 piece length 的文件，同时返回文件内容
+func createHybridForTest(t *testing.T) (*Metainfo, map[string][]byte) {
+	t.Helper()
+	root := filepath.Join(t.TempDir(), "content")
+	data := writeTestFiles(t, root, map[string]int{"big": 100000, "small": 3000})
+	meta, err := createTorrent(CreateOptions{Path: root, PieceLength: 16384, Hybrid: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return meta, data
+}
+
+// pureV2ForTest 去掉混合 torrent 的 v1 信息，返回纯 v2 的 info 字典和指向 peer 地址的磁力链接
+func pureV2ForTest(t *testing.T, created *Metainfo) ([]byte, func(address string) *Magnet) {
+	t.Helper()
+	info := created.Info
+	info.Pieces, info.FileList, info.Length = nil, nil, 0
+	infoBytes, err := Marshal(info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	infoHashV2 := sha256.Sum256(infoBytes)
+	link := func(address string) *Magnet {
+		magnet, err := decodeMagnetLink("magnet:?xt=urn:btmh:1220" + hex.EncodeToString(infoHashV2[:]) + "&x.pe=" + address)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return magnet
+	}
+	return infoBytes, link
+}
+
+func TestMagnetToTorrentHybrid(t *testing.T) {
+	created, _ := createHybridForTest(t)
+	peer := &testPeer{metadata: created.InfoBytes}
+	link := "magnet:?xt=urn:btih:" + hex.EncodeToString(created.InfoHash[:]) + "&x.pe=" + peer.start(t) + "&tr=http://tracker.invalid/announce"
+	magnet, err := decodeMagnetLink(link)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	output := filepath.Join(t.TempDir(), "hybrid.torrent")
+	if _, err := magnetToTorrent(magnet, output); err != nil {
+		t.Fatal(err)
+	}
+	saved, err := loadMetainfo(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(saved.InfoBytes, created.InfoBytes) || saved.InfoHash != created.InfoHash {
+		t.Fatal("saved info dictionary differs from the fetched metadata")
+	}
+	if len(saved.PieceLayers) != 0 {
+		t.Fatal("hybrid torrent should be saved without piece layers")
+	}
+	if saved.Announce != "http://tracker.invalid/announce" {
+		t.Fatalf("announce = %q", saved.Announce)
+	}
+}
+
+func TestMagnetToTorrentPureV2(t *testing.T) {
+	created, _ := createHybridForTest(t)
+	infoBytes, link := pureV2ForTest(t, created)
+	infoHashV2 := sha256.Sum256(infoBytes)
+
+	// 对方不提供 piece 层时报错，不写文件
+	output := filepath.Join(t.TempDir(), "v2.torrent")
+	rejecting := &testPeer{metadata: infoBytes, v2: true}
+	if _, err := magnetToTorrent(link(rejecting.start(t)), output); err == nil {
+		t.Fatal("expected an error when no peer provides the piece layers")
+	}
+	if _, err := os.Stat(output); !os.IsNotExist(err) {
+		t.Fatal("torrent file written after a failure")
+	}
+
+	good := &testPeer{metadata: infoBytes, layers: created.PieceLayers, pad: merklePadHash(1), v2: true}
+	if _, err := magnetToTorrent(link(good.start(t)), output); err != nil {
+		t.Fatal(err)
+	}
+	saved, err := loadMetainfoWithMode(output, BencodeStrict)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saved.Info.HasV1() || saved.InfoHashV2 != infoHashV2 || sha1.Sum(saved.InfoBytes) != saved.InfoHash {
+		t.Fatal("saved torrent does not match the magnet link")
+	}
+	if len(saved.PieceLayers) != len(created.PieceLayers) {
+		t.Fatalf("got %d piece layers, want %d", len(saved.PieceLayers), len(created.PieceLayers))
+	}
+	for root, layer := range created.PieceLayers {
+		if !bytes.Equal(saved.PieceLayers[root], layer) {
+			t.Fatal("piece layer differs")
+		}
+	}
+}
+
+// 纯 v2 torrent 的下载路径必须先获取 piece 层，否则无法校验长度超过 piece length 的文件
+func TestMagnetDownloadPureV2(t *testing.T) {
+	created, data := createHybridForTest(t)
+	infoBytes, link := pureV2ForTest(t, created)
+
+	// v2 的 piece 不跨越文件，按 file tree 的顺序切分每个文件
+	var pieces [][]byte
+	pieceLength := int(created.Info.PieceLength)
+	for _, file := range created.Info.V2Files {
+		content := data[strings.Join(file.Path, "/")]
+		for offset := 0; offset < len(content); offset += pieceLength {
+			pieces = append(pieces, content[offset:min(offset+pieceLength, len(content))])
+		}
+	}
+	if len(pieces) < 3 {
+		t.Fatalf("expected a multi-piece torrent, got %d pieces", len(pieces))
+	}
+	peer := &testPeer{metadata: infoBytes, layers: created.PieceLayers, pad: merklePadHash(1), pieces: pieces, v2: true}
+	address := peer.start(t)
+
+	output := filepath.Join(t.TempDir(), "download")
+	if err := downloadFileConcurrentWithMagnet(link(address), output); err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range data {
+		got, err := os.ReadFile(filepath.Join(output, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, content) {
+			t.Fatalf("%s: downloaded data differs", name)
+		}
+	}
+
+	piece, err := downloadPieceWithMagnet(filepath.Join(t.TempDir(), "piece"), 3, link(address))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(piece, pieces[3]) {
+		t.Fatal("piece 3 data differs")
+	}
+}
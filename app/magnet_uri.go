@@ -0,0 +1,244 @@
+package main
+
+import (
+	"encoding/base32"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Magnet 是解析后的磁力链接（BEP 9，v2 部分见 BEP 52）
+// magnet:?xt=urn:btih:ad42ce8109f54c99613ce38f9b4d87e70f24a165&dn=magnet1.gif&tr=http%3A%2F%2Fbittorrent-test-tracker.codecrafters.io%2Fannounce
+type Magnet struct {
+	InfoHash    [20]byte // xt=urn:btih:，40 位十六进制或 32 位 base32
+	HasV1       bool     // 是否有 btih（纯 v2 磁力链接只有 btmh）
+	InfoHashV2  [32]byte // xt=urn:btmh:，十六进制的 multihash（0x12 0x20 + SHA-256）
+	HasV2       bool
+	DisplayName string    // dn
+	Length      int64     // xl，0 表示未知
+	Trackers    []string  // 所有 tr，按出现顺序，去重
+	WebSeeds    []string  // 所有 ws（BEP 19），去重
+	Peers       []Address // 所有 x.pe，可以直接连接的 peer
+	SelectOnly  []int     // so（BEP 53）展开后的文件序号
+
+	trackers *TrackerTiers // 由 announceTiers 在第一次请求 peer 时创建
+}
+
+// decodeMagnetLink 解析磁力链接
+// 参数值按 URL 查询字符串解码（%XX 和 "+"）；同一个参数可以出现多次，也可以带序号后缀（如 tr.1、xt.2）
+func decodeMagnetLink(link string) (*Magnet, error) {
+	scheme, query, ok := strings.Cut(link, ":")
+	if !ok || !strings.EqualFold(scheme, "magnet") || !strings.HasPrefix(query, "?") {
+		return nil, fmt.Errorf("invalid magnet link: expected magnet:?..., got %q", link)
+	}
+
+	magnet := &Magnet{}
+	for _, part := range strings.Split(query[1:], "&") {
+		if part == "" {
+			continue
+		}
+		rawKey, rawValue, _ := strings.Cut(part, "=")
+		key, err := url.QueryUnescape(rawKey)
+		if err != nil {
+			return nil, fmt.Errorf("invalid magnet link: bad parameter name %q: %v", rawKey, err)
+		}
+		value, err := url.QueryUnescape(rawValue)
+		if err != nil {
+			return nil, fmt.Errorf("invalid magnet link: bad value for %s: %v", key, err)
+		}
+		// tr.1、xt.2 这样的序号后缀与不带后缀的参数相同
+		if index := strings.LastIndex(key, "."); index > 0 && isDigits(key[index+1:]) {
+			key = key[:index]
+		}
+
+		switch key {
+		case "xt":
+			err = magnet.parseExactTopic(value)
+		case "dn":
+			magnet.DisplayName = value
+		case "xl":
+			magnet.Length, err = strconv.ParseInt(value, 10, 64)
+			if err != nil || magnet.Length < 0 {
+				err = fmt.Errorf("invalid exact length %q", value)
+			}
+		case "tr":
+			if value != "" && !slices.Contains(magnet.Trackers, value) {
+				magnet.Trackers = append(magnet.Trackers, value)
+			}
+		case "ws":
+			if value != "" && !slices.Contains(magnet.WebSeeds, value) {
+				magnet.WebSeeds = append(magnet.WebSeeds, value)
+			}
+		case "x.pe":
+			var peer Address
+			peer, err = parsePeerAddress(value)
+			if err == nil && !slices.Contains(magnet.Peers, peer) {
+				magnet.Peers = append(magnet.Peers, peer)
+			}
+		case "so":
+			magnet.SelectOnly, err = parseSelectOnly(value)
+		}
+		// 忽略其他参数（如 kt、as、xs）
+		if err != nil {
+			return nil, fmt.Errorf("invalid magnet link: %v", err)
+		}
+	}
+	if !magnet.HasV1 && !magnet.HasV2 {
+		return nil, errors.New("invalid magnet link: missing xt=urn:btih: or xt=urn:btmh: info hash")
+	}
+	return magnet, nil
+}
+
+// parseExactTopic 解析一个 xt 参数，不认识的 urn 类型直接忽略
+func (m *Magnet) parseExactTopic(value string) error {
+	lower := strings.ToLower(value)
+	switch {
+	case strings.HasPrefix(lower, "urn:btih:"):
+		hash, err := decodeBTIH(value[len("urn:btih:"):])
+		if err != nil {
+			return err
+		}
+		if m.HasV1 && hash != m.InfoHash {
+			return errors.New("conflicting urn:btih info hashes")
+		}
+		m.InfoHash, m.HasV1 = hash, true
+	case strings.HasPrefix(lower, "urn:btmh:"):
+		// multihash：0x12 表示 SHA-256，0x20 是摘要长度 32
+		multihash, err := hex.DecodeString(value[len("urn:btmh:"):])
+		if err != nil || len(multihash) != 34 || multihash[0] != 0x12 || multihash[1] != 0x20 {
+			return fmt.Errorf("invalid urn:btmh info hash %q, expected hex-encoded sha2-256 multihash", value[len("urn:btmh:"):])
+		}
+		var hash [32]byte
+		copy(hash[:], multihash[2:])
+		if m.HasV2 && hash != m.InfoHashV2 {
+			return errors.New("conflicting urn:btmh info hashes")
+		}
+		m.InfoHashV2, m.HasV2 = hash, true
+	}
+	return nil
+}
+
+// decodeBTIH 解码 btih info hash：40 位十六进制，或 32 位 base32（RFC 4648，不区分大小写）
+func decodeBTIH(value string) ([20]byte, error) {
+	var hash [20]byte
+	var decoded []byte
+	var err error
+	switch len(value) {
+	case 40:
+		decoded, err = hex.DecodeString(value)
+	case 32:
+		decoded, err = base32.StdEncoding.DecodeString(strings.ToUpper(value))
+	default:
+		return hash, fmt.Errorf("invalid urn:btih info hash %q, expected 40 hex or 32 base32 characters", value)
+	}
+	if err != nil || len(decoded) != 20 {
+		return hash, fmt.Errorf("invalid urn:btih info hash %q", value)
+	}
+	copy(hash[:], decoded)
+	return hash, nil
+}
+
+// parsePeerAddress 解析 x.pe 中的 peer 地址：host:port，IPv6 地址写成 [addr]:port
+func parsePeerAddress(value string) (Address, error) {
+	host, portString, err := net.SplitHostPort(value)
+	if err != nil || host == "" {
+		return Address{}, fmt.Errorf("invalid peer address %q", value)
+	}
+	port, err := strconv.Atoi(portString)
+	if err != nil || port <= 0 || port > 65535 {
+		return Address{}, fmt.Errorf("invalid peer address %q: bad port", value)
+	}
+	return Address{IP: host, Port: port}, nil
+}
+
+// parseSelectOnly 解析 so 参数：逗号分隔的文件序号或闭区间（如 0,2,4-6），展开为排序去重的序号列表
+func parseSelectOnly(value string) ([]int, error) {
+	// 限制展开后的数量，避免 0-999999999 这样的区间占用大量内存
+	const maxSelectOnly = 1 << 16
+	var indexes []int
+	for _, item := range strings.Split(value, ",") {
+		first, last, isRange := strings.Cut(item, "-")
+		if !isRange {
+			last = first
+		}
+		start, err1 := strconv.Atoi(first)
+		end, err2 := strconv.Atoi(last)
+		if err1 != nil || err2 != nil || start < 0 || end < start || end-start >= maxSelectOnly {
+			return nil, fmt.Errorf("invalid select-only item %q", item)
+		}
+		for index := start; index <= end; index++ {
+			indexes = append(indexes, index)
+		}
+		if len(indexes) > maxSelectOnly {
+			return nil, errors.New("too many select-only file indexes")
+		}
+	}
+	slices.Sort(indexes)
+	return slices.Compact(indexes), nil
+}
+
+// SwarmInfoHash 返回 tracker 请求和握手中使用的 20 字节 info hash
+// 与 Metainfo.SwarmInfoHash 相同：有 btih 时使用 v1 info hash，否则使用截断的 v2 info hash
+func (m *Magnet) SwarmInfoHash() []byte {
+	if m.HasV1 {
+		return m.InfoHash[:]
+	}
+	return m.InfoHashV2[:20]
+}
+
+// TrackerURL 返回第一个 tracker，没有时返回空字符串
+func (m *Magnet) TrackerURL() string {
+	if len(m.Trackers) == 0 {
+		return ""
+	}
+	return m.Trackers[0]
+}
+
+// InfoHashHex 返回 v1 info hash 的十六进制形式，纯 v2 磁力链接返回空字符串
+func (m *Magnet) InfoHashHex() string {
+	if !m.HasV1 {
+		return ""
+	}
+	return hex.EncodeToString(m.InfoHash[:])
+}
+
+// String 格式化 magnet_parse 命令的输出，前两行与原来的格式相同，其他字段只在存在时输出
+func (m *Magnet) String() string {
+	var result strings.Builder
+	result.WriteString(fmt.Sprintf("Tracker URL: %s\nInfo Hash: %s", m.TrackerURL(), m.InfoHashHex()))
+	if m.HasV2 {
+		result.WriteString(fmt.Sprintf("\nInfo Hash v2: %x", m.InfoHashV2))
+	}
+	if m.DisplayName != "" {
+		result.WriteString("\nDisplay Name: " + m.DisplayName)
+	}
+	if m.Length > 0 {
+		result.WriteString(fmt.Sprintf("\nLength: %d", m.Length))
+	}
+	if len(m.Trackers) > 1 {
+		result.WriteString("\nTrackers: " + strings.Join(m.Trackers, ", "))
+	}
+	if len(m.WebSeeds) > 0 {
+		result.WriteString("\nWeb Seeds: " + strings.Join(m.WebSeeds, ", "))
+	}
+	if len(m.Peers) > 0 {
+		peers := make([]string, len(m.Peers))
+		for i, peer := range m.Peers {
+			peers[i] = net.JoinHostPort(peer.IP, strconv.Itoa(peer.Port))
+		}
+		result.WriteString("\nPeers: " + strings.Join(peers, ", "))
+	}
+	if len(m.SelectOnly) > 0 {
+		indexes := make([]string, len(m.SelectOnly))
+		for i, index := range m.SelectOnly {
+			indexes[i] = strconv.Itoa(index)
+		}
+		result.WriteString("\nSelect Only: " + strings.Join(indexes, ","))
+	}
+	return result.String()
+}
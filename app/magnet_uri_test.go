@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/hex"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDecodeMagnetLink(t *testing.T) {
+	const btih = "ad42ce8109f54c99613ce38f9b4d87e70f24a165"
+	var infoHash [20]byte
+	hex.Decode(infoHash[:], []byte(btih))
+	const btmh = "1220" + "c1a8cd6e1b4f6b3cbd8d1b7d4f1e0a2f0e3b7c9d5a6e8f7a1b2c3d4e5f6a7b8c"
+	var infoHashV2 [32]byte
+	hex.Decode(infoHashV2[:], []byte(btmh[4:]))
+
+	tests := []struct {
+		name     string
+		link     string
+		expected Magnet
+	}{
+		{
+			name:     "hex btih",
+			link:     "magnet:?xt=urn:btih:" + btih + "&dn=magnet1.gif&tr=http%3A%2F%2Ftracker.example%2Fannounce",
+			expected: Magnet{InfoHash: infoHash, HasV1: true, DisplayName: "magnet1.gif", Trackers: []string{"http://tracker.example/announce"}},
+		},
+		{
+			name:     "uppercase hex btih",
+			link:     "MAGNET:?xt=urn:BTIH:" + strings.ToUpper(btih),
+			expected: Magnet{InfoHash: infoHash, HasV1: true},
+		},
+		{
+			name:     "base32 btih",
+			link:     "magnet:?xt=urn:btih:VVBM5AIJ6VGJSYJ44OHZWTMH44HSJILF",
+			expected: Magnet{InfoHash: infoHash, HasV1: true},
+		},
+		{
+			name:     "lowercase base32 btih",
+			link:     "magnet:?xt=urn:btih:vvbm5aij6vgjsyj44ohzwtmh44hsjilf",
+			expected: Magnet{InfoHash: infoHash, HasV1: true},
+		},
+		{
+			name: "indexed parameters",
+			link: "magnet:?xt.1=urn:btih:" + btih + "&tr.1=http://a/announce&tr.2=http://b/announce&tr=http://a/announce&ws.1=http://seed/",
+			expected: Magnet{InfoHash: infoHash, HasV1: true,
+				Trackers: []string{"http://a/announce", "http://b/announce"}, WebSeeds: []string{"http://seed/"}},
+		},
+		{
+			name: "escaped & inside a tracker URL",
+			link: "magnet:?xt=urn:btih:" + btih + "&tr=http%3A%2F%2Ft%2Fannounce%3Fpasskey%3Dx%26y%3D1&dn=a+b%26c",
+			expected: Magnet{InfoHash: infoHash, HasV1: true, DisplayName: "a b&c",
+				Trackers: []string{"http://t/announce?passkey=x&y=1"}},
+		},
+		{
+			name: "peer addresses",
+			link: "magnet:?xt=urn:btih:" + btih + "&x.pe=127.0.0.1:6881&x.pe=%5B2001%3Adb8%3A%3A1%5D%3A51413&x.pe=[::1]:80&x.pe=127.0.0.1:6881",
+			expected: Magnet{InfoHash: infoHash, HasV1: true, Peers: []Address{
+				{IP: "127.0.0.1", Port: 6881}, {IP: "2001:db8::1", Port: 51413}, {IP: "::1", Port: 80}}},
+		},
+		{
+			name:     "select-only ranges",
+			link:     "magnet:?xt=urn:btih:" + btih + "&so=5,0,2-4,3&xl=1024",
+			expected: Magnet{InfoHash: infoHash, HasV1: true, Length: 1024, SelectOnly: []int{0, 2, 3, 4, 5}},
+		},
+		{
+			name:     "btmh only",
+			link:     "magnet:?xt=urn:btmh:" + btmh,
+			expected: Magnet{InfoHashV2: infoHashV2, HasV2: true},
+		},
+		{
+			name:     "hybrid btih and btmh, unknown topics ignored",
+			link:     "magnet:?xt=urn:sha1:abc&xt=urn:btih:" + btih + "&xt=urn:btmh:" + btmh + "&kt=x",
+			expected: Magnet{InfoHash: infoHash, HasV1: true, InfoHashV2: infoHashV2, HasV2: true},
+		},
+	}
+	for _, test := range tests {
+		magnet, err := decodeMagnetLink(test.link)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if !reflect.DeepEqual(*magnet, test.expected) {
+			t.Fatalf("%s: got %+v, expected %+v", test.name, *magnet, test.expected)
+		}
+	}
+
+	// so 展开后最多 65536 个序号
+	magnet, err := decodeMagnetLink("magnet:?xt=urn:btih:" + btih + "&so=0-65535")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(magnet.SelectOnly) != 1<<16 || magnet.SelectOnly[len(magnet.SelectOnly)-1] != 65535 {
+		t.Fatalf("got %d select-only indexes", len(magnet.SelectOnly))
+	}
+}
+
+func TestDecodeMagnetLinkErrors(t *testing.T) {
+	const btih = "ad42ce8109f54c99613ce38f9b4d87e70f24a165"
+	tests := map[string]string{
+		"http://example.com/?xt=urn:btih:" + btih:              "expected magnet:?",
+		"magnet:xt=urn:btih:" + btih:                           "expected magnet:?",
+		"magnet:?dn=name&tr=http://t/announce":                 "missing xt",
+		"magnet:?xt=urn:sha1:" + btih:                          "missing xt",
+		"magnet:?":                                             "missing xt",
+		"magnet:?xt=urn:btih:" + btih[:39]:                     "expected 40 hex or 32 base32",
+		"magnet:?xt=urn:btih:" + btih[:39] + "z":               "invalid urn:btih",
+		"magnet:?xt=urn:btih:VVBM5AIJ6VGJSYJ44OHZWTMH44HSJIL1": "invalid urn:btih",
+		"magnet:?xt=urn:btih:" + btih + "&xt=urn:btih:VVBM5AIJ6VGJSYJ44OHZWTMH44HSJILA": "conflicting urn:btih",
+		"magnet:?xt=urn:btmh:1114" + strings.Repeat("00", 20):                           "invalid urn:btmh",
+		"magnet:?xt=urn:btmh:1220" + strings.Repeat("00", 31):                           "invalid urn:btmh",
+		"magnet:?xt=urn:btih:" + btih + "&x.pe=127.0.0.1":                               "invalid peer address",
+		"magnet:?xt=urn:btih:" + btih + "&x.pe=::1:80":                                  "invalid peer address",
+		"magnet:?xt=urn:btih:" + btih + "&x.pe=127.0.0.1:0":                             "bad port",
+		"magnet:?xt=urn:btih:" + btih + "&x.pe=127.0.0.1:65536":                         "bad port",
+		"magnet:?xt=urn:btih:" + btih + "&so=3-1":                                       "invalid select-only",
+		"magnet:?xt=urn:btih:" + btih + "&so=-1":                                        "invalid select-only",
+		"magnet:?xt=urn:btih:" + btih + "&so=0-65536":                                   "invalid select-only",
+		"magnet:?xt=urn:btih:" + btih + "&so=0-65535,70000":                             "too many select-only",
+		"magnet:?xt=urn:btih:" + btih + "&xl=-1":                                        "invalid exact length",
+		"magnet:?xt=urn:btih:" + btih + "&tr=%zz":                                       "bad value for tr",
+	}
+	for link, expected := range tests {
+		_, err := decodeMagnetLink(link)
+		if err == nil || !strings.Contains(err.Error(), expected) {
+			t.Fatalf("%s: expected %q error, got %v", link, expected, err)
+		}
+	}
+}
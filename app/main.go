@@ -3,48 +3,180 @@ package main
 import (
 	"encoding/json"
 	"fmt"
+	"io"
 	"os"
 	"strconv"
+	"strings"
 )
 
 func main() {
 	// You can use print statements as follows for debugging, they'll be visible when running tests.
 	fmt.Fprintln(os.Stderr, "Logs from your program will appear here!")
 
+	if len(os.Args) < 2 {
+		fmt.Println("usage: your_program.sh <command> [<args>...]")
+		os.Exit(1)
+	}
 	command := os.Args[1]
 
 	switch command {
 	case "decode":
-		// TODO: Uncomment the code below to pass the first stage
-		//
-		bencodedValue := os.Args[2]
+		// decode [--strict|--lenient] [--binary=hex|base64] [<bencoded_value> | --file <path> | -]
+		mode, args := parseBencodeModeFlag(os.Args[2:])
+		input, binaryMode, err := parseDecodeArgs(args)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		if closer, ok := input.(io.Closer); ok {
+			defer closer.Close()
+		}
 
-		decoded, _, err := decodeBencode(bencodedValue)
+		decoded, err := decodeBencodeReader(input, mode)
 		if err != nil {
 			fmt.Println(err)
-			return
+			os.Exit(1)
 		}
 
-		jsonOutput, _ := json.Marshal(decoded)
+		jsonOutput, _ := json.Marshal(bencodeToJSONValue(decoded.Value, binaryMode))
 		fmt.Println(string(jsonOutput))
+	case "dump":
+		// dump [--binary=hex|base64] [<bencoded_value> | --file <path> | -]
+		// 总是使用宽松模式解码，非规范写法会在输出中标出而不是直接报错
+		input, binaryMode, err := parseDecodeArgs(os.Args[2:])
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		if closer, ok := input.(io.Closer); ok {
+			defer closer.Close()
+		}
+
+		root, err := decodeBencodeReader(input, BencodeLenient)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		dumpBencode(os.Stdout, root, binaryMode)
+	case "encode":
+		// encode [<json>]，不提供参数或参数为 "-" 时从标准输入读取
+		var input io.Reader = os.Stdin
+		if len(os.Args) > 2 && os.Args[2] != "-" {
+			input = strings.NewReader(os.Args[2])
+		}
+		encoded, err := encodeJSONToBencode(input)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		// 输出原始字节，不追加换行，方便直接重定向为文件
+		os.Stdout.WriteString(encoded)
+	case "create":
+		// create [--tracker <url>[,<url>...]]... [--comment <text>] [--private] [--piece-length <bytes>] [-o <output>] <path>
+		opts, err := parseCreateArgs(os.Args[2:])
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		response, err := create(opts)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		fmt.Println(response)
+	case "edit":
+		// edit [--tracker <url>[,<url>...]]... [--clear-trackers] [--web-seed <url>]... [--clear-web-seeds] [--comment <text>] [--created-by <text>] [-o <output>] <torrent_file>
+		opts, err := parseEditArgs(os.Args[2:])
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		response, err := edit(opts)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		fmt.Println(response)
 	case "info":
-		torrentFile := os.Args[2]
-		response := getInfoFromTorrentFile(torrentFile)
+		// info [--strict|--lenient] [--json] <torrent_file>
+		mode, args := parseBencodeModeFlag(os.Args[2:])
+		jsonMode, args := parseJSONFlag(args)
+		checkArgs(command, jsonMode, args, 1, "info [--strict|--lenient] [--json] <torrent_file>")
+		torrentFile := args[0]
+		if jsonMode {
+			meta, err := loadMetainfoWithMode(torrentFile, mode)
+			if err != nil {
+				exitWithJSONError(command, fmt.Errorf("error loading torrent file: %v", err))
+			}
+			printJSON(newTorrentInfoJSON(meta))
+			return
+		}
+		response := getInfoFromTorrentFile(torrentFile, mode)
 		fmt.Println(response)
+	case "verify":
+		// verify [--strict|--lenient] <torrent_file> <path>
+		mode, args := parseBencodeModeFlag(os.Args[2:])
+		checkArgs(command, false, args, 2, "verify <torrent_file> <path>")
+		meta, err := loadMetainfoWithMode(args[0], mode)
+		if err != nil {
+			fmt.Printf("Error loading torrent file: %v\n", err)
+			os.Exit(1)
+		}
+		report, err := verifyData(meta, args[1])
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		fmt.Println(report)
+		if !report.OK() {
+			os.Exit(1)
+		}
 	case "peers":
-		torrentFile := os.Args[2]
+		// peers [--json] <torrent_file>
+		jsonMode, args := parseJSONFlag(os.Args[2:])
+		checkArgs(command, jsonMode, args, 1, "peers [--json] <torrent_file>")
+		torrentFile := args[0]
+		if jsonMode {
+			meta, err := loadMetainfo(torrentFile)
+			if err != nil {
+				exitWithJSONError(command, fmt.Errorf("error loading torrent file: %v", err))
+			}
+			peers, err := requestPeers(meta)
+			if err == errNoTrackers {
+				exitWithJSONError(command, err)
+			}
+			if err != nil {
+				exitWithJSONError(command, fmt.Errorf("error requesting peers from tracker: %v", err))
+			}
+			printJSON(newPeersJSON(peers))
+			return
+		}
 		response, _ := getPeerAddress(torrentFile)
 		fmt.Println(response)
 	case "handshake":
-		torrentFile := os.Args[2]
-		address := os.Args[3]
+		// handshake [--json] <torrent_file> <peer_ip>:<peer_port>
+		jsonMode, args := parseJSONFlag(os.Args[2:])
+		checkArgs(command, jsonMode, args, 2, "handshake [--json] <torrent_file> <peer_ip>:<peer_port>")
+		torrentFile := args[0]
+		address := args[1]
+		if jsonMode {
+			peer, err := peerHandshake(torrentFile, address)
+			if err != nil {
+				exitWithJSONError(command, err)
+			}
+			printJSON(newHandshakeJSON(peer))
+			return
+		}
 		response := handshake(torrentFile, address)
 		fmt.Println(response)
 	case "download_piece":
-		tag := os.Args[2]
-		piecePath := os.Args[3]
-		torrentFile := os.Args[4]
-		pieceIndex := os.Args[5]
+		// download_piece <tag> <piece_path> <torrent_file> <piece_index>
+		args := os.Args[2:]
+		checkArgs(command, false, args, 4, "download_piece <tag> <piece_path> <torrent_file> <piece_index>")
+		tag := args[0]
+		piecePath := args[1]
+		torrentFile := args[2]
+		pieceIndex := args[3]
 		pieceIndexInt, err := strconv.Atoi(pieceIndex)
 		if err != nil {
 			fmt.Println("Invalid piece index: " + pieceIndex)
@@ -56,90 +188,194 @@ func main() {
 			os.Exit(1)
 		}
 	case "download":
-		// tag := os.Args[2]
-		savePath := os.Args[3]
-		torrentFile := os.Args[4]
-		// err := download(savePath, torrentFile)
-		// if err != nil {
-		// 	fmt.Println(err)
-		// 	os.Exit(1)
-		// }
-		// 并发版本
+		// download <tag> <output_path> <torrent_file>
+		args := os.Args[2:]
+		checkArgs(command, false, args, 3, "download <tag> <output_path> <torrent_file>")
+		savePath := args[1]
+		torrentFile := args[2]
 		err := downloadFileConcurrent(torrentFile, savePath)
 		if err != nil {
 			fmt.Println(err)
 			os.Exit(1)
 		}
 	case "magnet_parse":
-		link := os.Args[2]
-		decoded, err := decodeMagnetLink(link)
+		// magnet_parse [--json] <magnet_link>
+		jsonMode, args := parseJSONFlag(os.Args[2:])
+		checkArgs(command, jsonMode, args, 1, "magnet_parse [--json] <magnet_link>")
+		link := args[0]
+		magnet, err := decodeMagnetLink(link)
 		if err != nil {
-			fmt.Println(err)
-			os.Exit(1)
+			exitWithError(command, jsonMode, err)
 		}
-		response := ""
-		for k, v := range decoded {
-			response += k + ": " + v + "\n"
+		if jsonMode {
+			printJSON(newMagnetLinkJSON(magnet))
+			return
 		}
-		fmt.Println(response)
+		fmt.Println(magnet)
 	case "magnet_handshake":
-		link := os.Args[2]
-		decoded, err := decodeMagnetLink(link)
+		// magnet_handshake [--json] <magnet_link>
+		jsonMode, args := parseJSONFlag(os.Args[2:])
+		checkArgs(command, jsonMode, args, 1, "magnet_handshake [--json] <magnet_link>")
+		link := args[0]
+		magnet, err := decodeMagnetLink(link)
 		if err != nil {
-			fmt.Println(err)
-			os.Exit(1)
+			exitWithError(command, jsonMode, err)
 		}
-		_, response, _, _, _, err := magnetHandshake(decoded)
+		conn, peer, err := magnetHandshake(magnet)
 		if err != nil {
-			fmt.Println(err)
-			os.Exit(1)
+			exitWithError(command, jsonMode, err)
 		}
-		fmt.Println(response)
+		conn.Close()
+		if jsonMode {
+			printJSON(newHandshakeJSON(peer))
+			return
+		}
+		fmt.Println(formatMagnetHandshake(peer))
 	case "magnet_info":
-		link := os.Args[2]
-		decoded, err := decodeMagnetLink(link)
+		// magnet_info [--json] <magnet_link>
+		jsonMode, args := parseJSONFlag(os.Args[2:])
+		checkArgs(command, jsonMode, args, 1, "magnet_info [--json] <magnet_link>")
+		link := args[0]
+		magnet, err := decodeMagnetLink(link)
 		if err != nil {
-			fmt.Println(err)
-			os.Exit(1)
+			exitWithError(command, jsonMode, err)
 		}
-		response := magnetInfo(decoded)
+		if jsonMode {
+			meta, err := fetchMagnetMetainfo(magnet)
+			if err != nil {
+				exitWithJSONError(command, err)
+			}
+			printJSON(newTorrentInfoJSON(meta))
+			return
+		}
+		response := magnetInfo(magnet)
 		fmt.Println(response)
 	case "magnet_download_piece":
-		// tag := os.Args[2]
-		piecePath := os.Args[3]
-		magnetLink := os.Args[4]
-		pieceIndex := os.Args[5]
+		// magnet_download_piece <tag> <piece_path> <magnet_link> <piece_index>
+		args := os.Args[2:]
+		checkArgs(command, false, args, 4, "magnet_download_piece <tag> <piece_path> <magnet_link> <piece_index>")
+		piecePath := args[1]
+		magnetLink := args[2]
+		pieceIndex := args[3]
 		pieceIndexInt, err := strconv.Atoi(pieceIndex)
 		if err != nil {
 			fmt.Println("Invalid piece index: " + pieceIndex)
 			os.Exit(1)
 		}
-		decodedMap, err := decodeMagnetLink(magnetLink)
+		magnet, err := decodeMagnetLink(magnetLink)
 		if err != nil {
 			fmt.Println(err)
 			os.Exit(1)
 		}
-		_, err = downloadPieceWithMagnet(piecePath, pieceIndexInt, decodedMap)
+		_, err = downloadPieceWithMagnet(piecePath, pieceIndexInt, magnet)
 		if err != nil {
 			fmt.Println(err)
 			os.Exit(1)
 		}
 	case "magnet_download":
-		// tag := os.Args[2]
-		filePath := os.Args[3]
-		magnetLink := os.Args[4]
-		decodedMap, err := decodeMagnetLink(magnetLink)
+		// magnet_download <tag> <output_path> <magnet_link>
+		args := os.Args[2:]
+		checkArgs(command, false, args, 3, "magnet_download <tag> <output_path> <magnet_link>")
+		filePath := args[1]
+		magnetLink := args[2]
+		magnet, err := decodeMagnetLink(magnetLink)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		err = downloadFileConcurrentWithMagnet(magnet, filePath)
 		if err != nil {
 			fmt.Println(err)
 			os.Exit(1)
 		}
-		err = downloadFileConcurrentWithMagnet(decodedMap, filePath)
+	case "magnet_to_torrent":
+		// magnet_to_torrent [-o <output>] <magnet_link>
+		link, outputPath, err := parseMagnetToTorrentArgs(os.Args[2:])
 		if err != nil {
 			fmt.Println(err)
 			os.Exit(1)
 		}
+		magnet, err := decodeMagnetLink(link)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		response, err := magnetToTorrent(magnet, outputPath)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		fmt.Println(response)
 	default:
 		fmt.Println("Unknown command: " + command)
 		os.Exit(1)
 	}
 }
+
+// parseBencodeModeFlag 从参数中取出 --strict / --lenient，返回解码模式和剩余参数（默认宽松模式）
+func parseBencodeModeFlag(args []string) (BencodeMode, []string) {
+	mode := BencodeLenient
+	rest := make([]string, 0, len(args))
+	for _, arg := range args {
+		switch arg {
+		case "--strict":
+			mode = BencodeStrict
+		case "--lenient":
+			mode = BencodeLenient
+		default:
+			rest = append(rest, arg)
+		}
+	}
+	return mode, rest
+}
+
+// parseDecodeArgs 解析 decode 命令的输入来源和二进制字符串的输出格式
+// 输入可以是命令行参数本身、--file 指定的文件，或者标准输入（"-" 或不提供参数），只能给出一个
+// 所有参数检查通过后才打开文件，出错时不会留下打开的文件
+func parseDecodeArgs(args []string) (io.Reader, string, error) {
+	binaryMode := "hex"
+	var source, value string // source 是 "value"、"file" 或 "stdin"，为空表示没有给出输入
+	setSource := func(kind string, arg string) error {
+		if source != "" {
+			return fmt.Errorf("only one input can be given (a bencoded value, --file <path> or -), got another input %q", arg)
+		}
+		source, value = kind, arg
+		return nil
+	}
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		var err error
+		switch {
+		case strings.HasPrefix(arg, "--binary="):
+			binaryMode = strings.TrimPrefix(arg, "--binary=")
+			if binaryMode != "hex" && binaryMode != "base64" {
+				return nil, "", fmt.Errorf("invalid --binary value %q, expected hex or base64", binaryMode)
+			}
+		case arg == "-f" || arg == "--file":
+			if i+1 >= len(args) {
+				return nil, "", fmt.Errorf("%s requires a file path", arg)
+			}
+			i++
+			err = setSource("file", args[i])
+		case arg == "-":
+			err = setSource("stdin", arg)
+		default:
+			err = setSource("value", arg)
+		}
+		if err != nil {
+			return nil, "", err
+		}
+	}
+
+	switch source {
+	case "file":
+		file, err := os.Open(value)
+		if err != nil {
+			return nil, "", fmt.Errorf("error opening file: %v", err)
+		}
+		return file, binaryMode, nil
+	case "value":
+		return strings.NewReader(value), binaryMode, nil
+	}
+	return os.Stdin, binaryMode, nil
+}
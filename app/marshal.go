@@ -0,0 +1,353 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math/big"
+	"reflect"
+	"strings"
+)
+
+// RawBencode 是一段原始的 bencode 编码值
+// Marshal 时原样写出，Unmarshal 时保存输入中的原始字节（例如需要计算哈希的 info 字典）
+// 空的 RawBencode 不是合法的 bencode 值：Marshal 时带 omitempty 的字段会被省略，否则返回错误
+type RawBencode []byte
+
+// errEmptyRawBencode 表示要写出的 RawBencode 为空，原样写出会得到缺少值的字典
+var errEmptyRawBencode = errors.New("bencode: cannot marshal empty RawBencode")
+
+var rawBencodeType = reflect.TypeOf(RawBencode(nil))
+
+// bigIntType 用于支持超出 64 位范围的整数字段（*big.Int）
+var bigIntType = reflect.TypeOf(big.Int{})
+
+// Marshal 把 Go 值编码为 bencode
+// 结构体字段通过 `bencode:"piece length,omitempty"` 标签指定键名，"-" 表示忽略该字段
+func Marshal(v interface{}) ([]byte, error) {
+	value, err := toBencodeValue(reflect.ValueOf(v))
+	if err != nil {
+		return nil, err
+	}
+	encoded, err := encodeBencode(value)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(encoded), nil
+}
+
+// Unmarshal 把 bencode 数据解码到 v 指向的值中
+func Unmarshal(data []byte, v interface{}) error {
+	_, err := unmarshalPrefix(data, v)
+	return err
+}
+
+// unmarshalPrefix 解码 data 开头的一个 bencode 值到 v 中，返回该值占用的字节数
+// 用于值后面还跟着其它数据的场景（例如 ut_metadata 的 data 消息）
+func unmarshalPrefix(data []byte, v interface{}) (int, error) {
+	node, err := NewBencodeDecoder(bytes.NewReader(data)).Decode()
+	if err != nil {
+		return 0, err
+	}
+	if err := unmarshalBencodeNode(node, v); err != nil {
+		return 0, err
+	}
+	return len(node.Raw), nil
+}
+
+// unmarshalBencodeNode 把已经解码的节点填充到 v 指向的值中
+func unmarshalBencodeNode(node *BencodeNode, v interface{}) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() {
+		return errors.New("bencode: Unmarshal target must be a non-nil pointer")
+	}
+	return setFromNode(node, rv.Elem(), "")
+}
+
+// bencodeField 描述结构体中一个参与编解码的字段
+type bencodeField struct {
+	name      string
+	index     int
+	omitEmpty bool
+}
+
+func structFields(t reflect.Type) []bencodeField {
+	fields := make([]bencodeField, 0, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" {
+			continue // 未导出字段
+		}
+		tag := f.Tag.Get("bencode")
+		if tag == "-" {
+			continue
+		}
+		name, opts, _ := strings.Cut(tag, ",")
+		if name == "" {
+			name = f.Name
+		}
+		fields = append(fields, bencodeField{
+			name:      name,
+			index:     i,
+			omitEmpty: opts == "omitempty",
+		})
+	}
+	return fields
+}
+
+// toBencodeValue 把任意 Go 值转换为 encodeBencode 能处理的值
+func toBencodeValue(rv reflect.Value) (interface{}, error) {
+	if !rv.IsValid() {
+		return nil, errors.New("bencode: cannot marshal nil value")
+	}
+	if rv.Type() == rawBencodeType {
+		if rv.Len() == 0 {
+			return nil, errEmptyRawBencode
+		}
+		return RawBencode(rv.Bytes()), nil
+	}
+	if rv.Type() == bigIntType {
+		if rv.CanAddr() {
+			return rv.Addr().Interface().(*big.Int), nil
+		}
+		value := rv.Interface().(big.Int)
+		return &value, nil
+	}
+
+	switch rv.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if rv.IsNil() {
+			return nil, errors.New("bencode: cannot marshal nil " + rv.Type().String())
+		}
+		return toBencodeValue(rv.Elem())
+	case reflect.String:
+		return rv.String(), nil
+	case reflect.Bool:
+		// bencode 没有布尔类型，按惯例编码为 0/1（例如 info.private）
+		if rv.Bool() {
+			return 1, nil
+		}
+		return 0, nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return rv.Int(), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return rv.Uint(), nil
+	case reflect.Slice, reflect.Array:
+		if rv.Type().Elem().Kind() == reflect.Uint8 {
+			// []byte 和 [N]byte 编码为字符串
+			b := make([]byte, rv.Len())
+			reflect.Copy(reflect.ValueOf(b), rv)
+			return b, nil
+		}
+		list := make([]interface{}, 0, rv.Len())
+		for i := 0; i < rv.Len(); i++ {
+			item, err := toBencodeValue(rv.Index(i))
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, item)
+		}
+		return list, nil
+	case reflect.Map:
+		if rv.Type().Key().Kind() != reflect.String {
+			return nil, errors.New("bencode: map key must be a string, got " + rv.Type().Key().String())
+		}
+		dict := make(map[string]interface{}, rv.Len())
+		iter := rv.MapRange()
+		for iter.Next() {
+			item, err := toBencodeValue(iter.Value())
+			if err != nil {
+				return nil, err
+			}
+			dict[iter.Key().String()] = item
+		}
+		return dict, nil
+	case reflect.Struct:
+		dict := make(map[string]interface{})
+		for _, f := range structFields(rv.Type()) {
+			fv := rv.Field(f.index)
+			if f.omitEmpty && (fv.IsZero() || fv.Type() == rawBencodeType && fv.Len() == 0) {
+				continue
+			}
+			if (fv.Kind() == reflect.Ptr || fv.Kind() == reflect.Interface) && fv.IsNil() {
+				continue // nil 指针视为不存在的键
+			}
+			item, err := toBencodeValue(fv)
+			if err != nil {
+				return nil, fmt.Errorf("%v (field %q)", err, f.name)
+			}
+			dict[f.name] = item
+		}
+		return dict, nil
+	default:
+		return nil, errors.New("bencode: unsupported type " + rv.Type().String())
+	}
+}
+
+func kindName(kind byte) string {
+	switch kind {
+	case 's':
+		return "string"
+	case 'i':
+		return "integer"
+	case 'l':
+		return "list"
+	case 'd':
+		return "dictionary"
+	}
+	return "unknown"
+}
+
+func joinFieldPath(path string, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+// setFromNode 把节点的值写入 rv，path 用于在错误信息中指出出错的位置
+func setFromNode(node *BencodeNode, rv reflect.Value, path string) error {
+	mismatch := func() error {
+		where := path
+		if where == "" {
+			where = "value"
+		}
+		return fmt.Errorf("bencode: cannot unmarshal %s at offset %d into %s (%s)", kindName(node.Kind), node.Offset, where, rv.Type())
+	}
+
+	if rv.Type() == rawBencodeType {
+		raw := make([]byte, len(node.Raw))
+		copy(raw, node.Raw)
+		rv.SetBytes(raw)
+		return nil
+	}
+	if rv.Type() == bigIntType {
+		if node.Kind != 'i' {
+			return mismatch()
+		}
+		value := rv.Addr().Interface().(*big.Int)
+		switch v := node.Value.(type) {
+		case int64:
+			value.SetInt64(v)
+		case *big.Int:
+			value.Set(v)
+		}
+		return nil
+	}
+
+	switch rv.Kind() {
+	case reflect.Interface:
+		if rv.NumMethod() != 0 {
+			return mismatch()
+		}
+		rv.Set(reflect.ValueOf(node.Value))
+		return nil
+	case reflect.Ptr:
+		if rv.IsNil() {
+			rv.Set(reflect.New(rv.Type().Elem()))
+		}
+		return setFromNode(node, rv.Elem(), path)
+	case reflect.String:
+		if node.Kind != 's' {
+			return mismatch()
+		}
+		rv.SetString(node.Value.(string))
+		return nil
+	case reflect.Bool:
+		if node.Kind != 'i' {
+			return mismatch()
+		}
+		// 超出 int64 范围的整数一定不为 0
+		value, ok := node.Value.(int64)
+		rv.SetBool(!ok || value != 0)
+		return nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if node.Kind != 'i' {
+			return mismatch()
+		}
+		value, ok := node.Value.(int64)
+		if !ok || rv.OverflowInt(value) {
+			return fmt.Errorf("bencode: integer %v at offset %d overflows %s", node.Value, node.Offset, rv.Type())
+		}
+		rv.SetInt(value)
+		return nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		if node.Kind != 'i' {
+			return mismatch()
+		}
+		// (2^63, 2^64) 之间的值由解码器保存为 *big.Int，但仍然可以放进 uint64
+		var value uint64
+		ok := false
+		switch v := node.Value.(type) {
+		case int64:
+			value, ok = uint64(v), v >= 0
+		case *big.Int:
+			value, ok = v.Uint64(), v.IsUint64()
+		}
+		if !ok || rv.OverflowUint(value) {
+			return fmt.Errorf("bencode: integer %v at offset %d overflows %s", node.Value, node.Offset, rv.Type())
+		}
+		rv.SetUint(value)
+		return nil
+	case reflect.Slice:
+		if rv.Type().Elem().Kind() == reflect.Uint8 {
+			if node.Kind != 's' {
+				return mismatch()
+			}
+			rv.SetBytes([]byte(node.Value.(string)))
+			return nil
+		}
+		if node.Kind != 'l' {
+			return mismatch()
+		}
+		slice := reflect.MakeSlice(rv.Type(), len(node.List), len(node.List))
+		for i, child := range node.List {
+			if err := setFromNode(child, slice.Index(i), fmt.Sprintf("%s[%d]", path, i)); err != nil {
+				return err
+			}
+		}
+		rv.Set(slice)
+		return nil
+	case reflect.Array:
+		if rv.Type().Elem().Kind() != reflect.Uint8 || node.Kind != 's' {
+			return mismatch()
+		}
+		str := node.Value.(string)
+		if len(str) != rv.Len() {
+			return fmt.Errorf("bencode: string of length %d at offset %d does not fit %s", len(str), node.Offset, rv.Type())
+		}
+		reflect.Copy(rv, reflect.ValueOf([]byte(str)))
+		return nil
+	case reflect.Map:
+		if node.Kind != 'd' || rv.Type().Key().Kind() != reflect.String {
+			return mismatch()
+		}
+		m := reflect.MakeMapWithSize(rv.Type(), len(node.Keys))
+		for _, key := range node.Keys {
+			elem := reflect.New(rv.Type().Elem()).Elem()
+			if err := setFromNode(node.Dict[key], elem, joinFieldPath(path, key)); err != nil {
+				return err
+			}
+			m.SetMapIndex(reflect.ValueOf(key).Convert(rv.Type().Key()), elem)
+		}
+		rv.Set(m)
+		return nil
+	case reflect.Struct:
+		if node.Kind != 'd' {
+			return mismatch()
+		}
+		// 未知的键直接忽略
+		for _, f := range structFields(rv.Type()) {
+			child, ok := node.Dict[f.name]
+			if !ok {
+				continue
+			}
+			if err := setFromNode(child, rv.Field(f.index), joinFieldPath(path, f.name)); err != nil {
+				return err
+			}
+		}
+		return nil
+	default:
+		return fmt.Errorf("bencode: unsupported type %s", rv.Type())
+	}
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestMarshalEmptyRawBencode(t *testing.T) {
+	// info 没有 omitempty，空的 info 字典不能写成 "4:info" 后面什么都没有
+	for _, meta := range []Metainfo{
+		{Announce: "x"},
+		{Announce: "x", InfoBytes: RawBencode{}},
+	} {
+		encoded, err := Marshal(meta)
+		if err == nil || !strings.Contains(err.Error(), errEmptyRawBencode.Error()) {
+			t.Fatalf("expected empty RawBencode error, got %q, %v", encoded, err)
+		}
+	}
+	if _, err := Marshal(RawBencode(nil)); !errors.Is(err, errEmptyRawBencode) {
+		t.Fatalf("expected empty RawBencode error, got %v", err)
+	}
+	if _, err := encodeBencode(map[string]interface{}{"a": RawBencode{}}); !errors.Is(err, errEmptyRawBencode) {
+		t.Fatalf("expected empty RawBencode error, got %v", err)
+	}
+
+	// 带 omitempty 的字段为 nil 或空时都省略
+	for _, urlList := range []RawBencode{nil, {}} {
+		encoded, err := Marshal(Metainfo{Announce: "x", URLList: urlList, InfoBytes: RawBencode("de")})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(encoded) != "d8:announce1:x4:infodee" {
+			t.Fatalf("got %q", encoded)
+		}
+	}
+}
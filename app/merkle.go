@@ -0,0 +1,63 @@
+package main
+
+import (
+	"crypto/sha256"
+)
+
+// BitTorrent v2（BEP 52）的 merkle 树
+// 叶子是文件中每个 16 KiB block 的 SHA-256（最后一个 block 按实际长度计算，不补零），
+// 叶子数量不足 2 的幂时用全零哈希补齐，父节点是 SHA-256(左子节点 || 右子节点)
+
+// merkleBlockSize 是 merkle 树叶子对应的 block 大小
+const merkleBlockSize = 16384
+
+// merkleLeafHashes 计算数据中每个 16 KiB block 的 SHA-256
+func merkleLeafHashes(data []byte) [][32]byte {
+	leaves := make([][32]byte, 0, (len(data)+merkleBlockSize-1)/merkleBlockSize)
+	for offset := 0; offset < len(data); offset += merkleBlockSize {
+		end := min(offset+merkleBlockSize, len(data))
+		leaves = append(leaves, sha256.Sum256(data[offset:end]))
+	}
+	return leaves
+}
+
+// merkleRoot 把 hashes 用 pad 补齐到 width 个（width 必须是 2 的幂且不小于 len(hashes)），计算树根
+func merkleRoot(hashes [][32]byte, width int, pad [32]byte) [32]byte {
+	layer := make([][32]byte, width)
+	copy(layer, hashes)
+	for i := len(hashes); i < width; i++ {
+		layer[i] = pad
+	}
+	var buffer [64]byte
+	for len(layer) > 1 {
+		for i := 0; i < len(layer)/2; i++ {
+			copy(buffer[:32], layer[2*i][:])
+			copy(buffer[32:], layer[2*i+1][:])
+			layer[i] = sha256.Sum256(buffer[:])
+		}
+		layer = layer[:len(layer)/2]
+	}
+	return layer[0]
+}
+
+// merklePadHash 返回由 leaves 个全零叶子组成的子树的根
+// piece 层的补齐节点就是一个 piece 大小的全零子树的根
+func merklePadHash(leaves int) [32]byte {
+	var hash [32]byte
+	var buffer [64]byte
+	for ; leaves > 1; leaves /= 2 {
+		copy(buffer[:32], hash[:])
+		copy(buffer[32:], hash[:])
+		hash = sha256.Sum256(buffer[:])
+	}
+	return hash
+}
+
+// nextPowerOfTwo 返回不小于 n 的最小的 2 的幂（n <= 1 时返回 1）
+func nextPowerOfTwo(n int) int {
+	power := 1
+	for power < n {
+		power *= 2
+	}
+	return power
+}
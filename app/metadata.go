@@ -0,0 +1,480 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ut_metadata（BEP 9）把 info 字典按 16 KiB 切成若干块传输，除最后一块外每块都是 16 KiB
+const metadataPieceSize = 16384
+
+// maxMetadataSize 是接受的元数据最大长度
+// total_size / metadata_size 来自对方，分配缓冲区之前必须检查；正常 torrent 的 info 字典远小于这个值
+const maxMetadataSize = 16 << 20
+
+// metadataBuffer 收集元数据的各个块，块可以按任意顺序到达
+type metadataBuffer struct {
+	totalSize int
+	pieces    [][]byte // 下标是块序号，nil 表示还没有收到
+	received  int
+
+	requested []int           // 每一块正在等待回复的请求数
+	senders   map[string]bool // 发送过块的 peer
+}
+
+// newMetadataBuffer 按元数据总长度创建缓冲区，长度不合法或超过上限时返回错误（此时不会分配内存）
+func newMetadataBuffer(totalSize int64) (*metadataBuffer, error) {
+	if totalSize <= 0 {
+		return nil, fmt.Errorf("error: invalid metadata size %d", totalSize)
+	}
+	if totalSize > maxMetadataSize {
+		return nil, fmt.Errorf("error: metadata size %d exceeds maximum of %d", totalSize, maxMetadataSize)
+	}
+	numPieces := (int(totalSize) + metadataPieceSize - 1) / metadataPieceSize
+	return &metadataBuffer{
+		totalSize: int(totalSize),
+		pieces:    make([][]byte, numPieces),
+		requested: make([]int, numPieces),
+		senders:   make(map[string]bool),
+	}, nil
+}
+
+// NumPieces 返回元数据的块数
+func (b *metadataBuffer) NumPieces() int {
+	return len(b.pieces)
+}
+
+// pieceLength 返回第 piece 块的长度
+func (b *metadataBuffer) pieceLength(piece int) int {
+	return min(metadataPieceSize, b.totalSize-piece*metadataPieceSize)
+}
+
+// Add 保存收到的一块，检查块序号和长度；重复收到的块直接忽略
+func (b *metadataBuffer) Add(piece int, data []byte) error {
+	if piece < 0 || piece >= len(b.pieces) {
+		return fmt.Errorf("error: metadata piece %d out of range (0-%d)", piece, len(b.pieces)-1)
+	}
+	if len(data) != b.pieceLength(piece) {
+		return fmt.Errorf("error: metadata piece %d has %d bytes, expected %d", piece, len(data), b.pieceLength(piece))
+	}
+	if b.pieces[piece] == nil {
+		b.pieces[piece] = data
+		b.received++
+	}
+	return nil
+}
+
+// Complete 判断是否已经收到所有块
+func (b *metadataBuffer) Complete() bool {
+	return b.received == len(b.pieces)
+}
+
+// Bytes 按顺序拼接所有块
+func (b *metadataBuffer) Bytes() []byte {
+	result := make([]byte, 0, b.totalSize)
+	for _, piece := range b.pieces {
+		result = append(result, piece...)
+	}
+	return result
+}
+
+// parseMetadataMessage 解析一条 ut_metadata 消息（不含扩展消息ID）：bencoded 字典，data 消息的元数据块紧跟在字典之后
+func parseMetadataMessage(payload []byte) (metadataMessage, []byte, error) {
+	var message metadataMessage
+	consumed, err := unmarshalPrefix(payload, &message)
+	if err != nil {
+		return message, nil, fmt.Errorf("error decoding metadata message: %v", err)
+	}
+	return message, payload[consumed:], nil
+}
+
+// maxMetadataPeers 是同时用于获取元数据的 peer 数，其余的 peer 在有 peer 被放弃后依次补上
+const maxMetadataPeers = 8
+
+// metadataRequestsPerPeer 是每个 peer 同时等待回复的元数据请求数
+const metadataRequestsPerPeer = 4
+
+// metadataFetcher 从多个 peer 并行获取同一份元数据
+// 块按 peer 声明的元数据长度分组拼接，长度不同的 peer 不会互相影响；一组拼接完成后用 verify 校验。
+// 校验失败时如果块只来自一个 peer，放弃这个 peer；来自多个 peer 时无法确定是谁的数据有误，
+// 丢弃这一组，之后每个 peer 单独拼接自己的块，再次校验失败时就能确定是哪个 peer
+type metadataFetcher struct {
+	verify  func([]byte) error
+	v2      bool          // 磁力链接有 v2 info hash，握手时设置 v2 协议位
+	timeout time.Duration // 等待每个请求的回复的最长时间
+
+	mu       sync.Mutex
+	buffers  map[metadataKey]*metadataBuffer
+	separate bool            // 多个 peer 的块拼接后校验失败过，之后每个 peer 单独拼接
+	dropped  map[string]bool // 发送过校验失败数据的 peer
+	result   []byte
+	done     chan struct{} // 获取到校验通过的元数据后关闭
+}
+
+// metadataKey 标识一组一起拼接的元数据块：元数据长度，以及单独拼接时的 peer
+type metadataKey struct {
+	size int64
+	peer string
+}
+
+// fetchMetadataFromPeers 并行连接 addresses 中的 peer 获取元数据，返回校验通过的元数据
+// 拒绝请求、超时（magnetPeerTimeout）、数据不合法或校验失败的 peer 会被放弃，换用其他 peer
+func fetchMetadataFromPeers(addresses []Address, infoHashBytes []byte, peerID []byte, v2 bool, verify func([]byte) error) ([]byte, error) {
+	return newMetadataFetcher(verify, v2).fetch(addresses, infoHashBytes, peerID)
+}
+
+// newMetadataFetcher 创建一个用 verify 校验元数据的 metadataFetcher，每个请求的超时时间为 magnetPeerTimeout
+func newMetadataFetcher(verify func([]byte) error, v2 bool) *metadataFetcher {
+	return &metadataFetcher{
+		verify:  verify,
+		v2:      v2,
+		timeout: magnetPeerTimeout,
+		buffers: make(map[metadataKey]*metadataBuffer),
+		dropped: make(map[string]bool),
+		done:    make(chan struct{}),
+	}
+}
+
+// fetch 是 fetchMetadataFromPeers 的实现，一个 metadataFetcher 只能使用一次
+func (f *metadataFetcher) fetch(addresses []Address, infoHashBytes []byte, peerID []byte) ([]byte, error) {
+	var wg sync.WaitGroup
+	var errMu sync.Mutex
+	var lastErr error
+	slots := make(chan struct{}, maxMetadataPeers)
+	for _, address := range addresses {
+		wg.Add(1)
+		go func(address Address) {
+			defer wg.Done()
+			select {
+			case slots <- struct{}{}:
+				defer func() { <-slots }()
+			case <-f.done:
+				return
+			}
+			err := f.fetchFromPeer(address, infoHashBytes, peerID)
+			if err != nil {
+				errMu.Lock()
+				lastErr = fmt.Errorf("peer %s: %v", net.JoinHostPort(address.IP, strconv.Itoa(address.Port)), err)
+				errMu.Unlock()
+			}
+		}(address)
+	}
+	finished := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(finished)
+	}()
+
+	// 获取成功后不等待其他 peer，它们的连接会被关闭，还在连接中的 peer 会在超时后退出
+	select {
+	case <-f.done:
+	case <-finished:
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.result != nil {
+		return f.result, nil
+	}
+	if lastErr == nil {
+		lastErr = errors.New("no peers")
+	}
+	return nil, fmt.Errorf("error: failed to fetch metadata from %d peers, last error: %v", len(addresses), lastErr)
+}
+
+// fetchFromPeer 与一个 peer 握手并获取元数据块，直到元数据获取完成或者放弃这个 peer
+// 对方在扩展握手中给出了 metadata_size 时直接请求缺少的块；否则先请求第 0 块，从回复的 total_size 得到总长度
+func (f *metadataFetcher) fetchFromPeer(address Address, infoHashBytes []byte, peerID []byte) error {
+	conn, peer, err := magnetHandshakeWithPeer(address, infoHashBytes, peerID, nil, f.v2)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	peerExtensionID := peer.MetadataExtensionID()
+	if peerExtensionID == 0 {
+		return errors.New("error: peer does not support ut_metadata")
+	}
+
+	// 其他 peer 完成获取后关闭连接，让阻塞在读取上的循环退出
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-f.done:
+			conn.Close()
+		case <-stop:
+		}
+	}()
+
+	name := conn.RemoteAddr().String()
+	size := peer.MetadataSize
+	outstanding := make(map[int]time.Time) // 已经发出、还没有收到回复的块 -> 发出请求的时间
+	defer func() {
+		f.release(size, name, outstanding)
+	}()
+	request := func(piece int) error {
+		message, err := buildMetadataRequestMessage(byte(peerExtensionID), piece)
+		if err != nil {
+			return fmt.Errorf("error building metadata request: %v", err)
+		}
+		_, err = conn.Write(message)
+		if err != nil {
+			return fmt.Errorf("error sending metadata request: %v", err)
+		}
+		outstanding[piece] = time.Now()
+		return nil
+	}
+	if size == 0 {
+		err = request(0)
+		if err != nil {
+			return err
+		}
+	}
+
+	for {
+		if size > 0 {
+			for len(outstanding) < metadataRequestsPerPeer {
+				piece, ok, err := f.nextPiece(size, name, outstanding)
+				if err != nil {
+					return err
+				}
+				if !ok {
+					break
+				}
+				err = request(piece)
+				if err != nil {
+					return err
+				}
+			}
+		}
+		if len(outstanding) == 0 {
+			// 所有块都已经收到，元数据正在校验或已经获取完成
+			return nil
+		}
+
+		// 超时从最早的、还没有收到回复的请求开始计算，忽略的消息不会延长超时：
+		// 对方只发送 keep-alive、have 等消息而一直不回复请求时，也会在 f.timeout 之后被放弃
+		var oldest time.Time
+		for _, sent := range outstanding {
+			if oldest.IsZero() || sent.Before(oldest) {
+				oldest = sent
+			}
+		}
+		conn.SetReadDeadline(oldest.Add(f.timeout))
+		messageID, payload, err := readPeerMessage(conn)
+		if err != nil {
+			return fmt.Errorf("error reading metadata response: %v", err)
+		}
+		// 只处理发给我们的 ut_metadata 消息，忽略 bitfield、have、keep-alive 和其他扩展消息
+		if messageID != 20 || len(payload) == 0 || payload[0] != ourMetadataExtensionID {
+			continue
+		}
+		message, data, err := parseMetadataMessage(payload[1:])
+		if err != nil {
+			return err
+		}
+		switch message.MsgType {
+		case metadataMsgReject:
+			return fmt.Errorf("error: peer rejected metadata piece %d", message.Piece)
+		case metadataMsgData:
+		default:
+			// 对方向我们请求元数据等，不影响获取
+			continue
+		}
+		if _, ok := outstanding[message.Piece]; !ok {
+			// 没有请求过的块，忽略
+			continue
+		}
+
+		if size == 0 {
+			size = int64(message.TotalSize)
+			f.mu.Lock()
+			_, err = f.buffer(size, name)
+			f.mu.Unlock()
+			if err != nil {
+				return err
+			}
+		} else if int64(message.TotalSize) != size {
+			return fmt.Errorf("error: metadata total_size changed from %d to %d", size, message.TotalSize)
+		}
+		delete(outstanding, message.Piece)
+		err = f.add(size, message.Piece, data, name)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// key 返回 peer（元数据长度为 size）的块所属的那一组，调用者需要持有 f.mu
+func (f *metadataFetcher) key(size int64, name string) metadataKey {
+	if f.separate {
+		return metadataKey{size: size, peer: name}
+	}
+	return metadataKey{size: size}
+}
+
+// buffer 返回 peer（元数据长度为 size）的块所属的那一组，还没有时创建，调用者需要持有 f.mu
+func (f *metadataFetcher) buffer(size int64, name string) (*metadataBuffer, error) {
+	key := f.key(size, name)
+	buffer := f.buffers[key]
+	if buffer == nil {
+		var err error
+		buffer, err = newMetadataBuffer(size)
+		if err != nil {
+			return nil, err
+		}
+		f.buffers[key] = buffer
+	}
+	return buffer, nil
+}
+
+// nextPiece 为一个 peer 选择下一个要请求的块：还没有收到、这个 peer 没有请求过、正在等待回复的请求最少的块
+// 所有缺少的块都已经向其他 peer 请求过时，同一块也会再向这个 peer 请求一次，避免慢的 peer 拖住整个获取
+func (f *metadataFetcher) nextPiece(size int64, name string, outstanding map[int]time.Time) (int, bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	buffer, err := f.buffer(size, name)
+	if err != nil {
+		return 0, false, err
+	}
+	best := -1
+	for piece := range buffer.pieces {
+		if _, ok := outstanding[piece]; buffer.pieces[piece] != nil || ok {
+			continue
+		}
+		if best < 0 || buffer.requested[piece] < buffer.requested[best] {
+			best = piece
+		}
+	}
+	if best < 0 {
+		return 0, false, nil
+	}
+	buffer.requested[best]++
+	return best, true, nil
+}
+
+// release 在 peer 退出时撤销它还没有收到回复的请求
+func (f *metadataFetcher) release(size int64, name string, outstanding map[int]time.Time) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	buffer := f.buffers[f.key(size, name)]
+	if buffer == nil {
+		return
+	}
+	for piece := range outstanding {
+		if buffer.requested[piece] > 0 {
+			buffer.requested[piece]--
+		}
+	}
+}
+
+// add 保存 name 发送的一块，这一组拼接完成时校验元数据
+func (f *metadataFetcher) add(size int64, piece int, data []byte, name string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.dropped[name] {
+		return errors.New("error: peer sent metadata that failed verification")
+	}
+	if f.result != nil {
+		return nil
+	}
+	buffer, err := f.buffer(size, name)
+	if err != nil {
+		return err
+	}
+	if buffer.requested[piece] > 0 {
+		buffer.requested[piece]--
+	}
+	err = buffer.Add(piece, data)
+	if err != nil {
+		return err
+	}
+	buffer.senders[name] = true
+	if !buffer.Complete() {
+		return nil
+	}
+
+	metadata := buffer.Bytes()
+	err = f.verify(metadata)
+	if err != nil {
+		// 丢弃这一组，同样长度的其他 peer 从头开始获取
+		delete(f.buffers, f.key(size, name))
+		if len(buffer.senders) > 1 {
+			f.separate = true
+			return nil
+		}
+		f.dropped[name] = true
+		return err
+	}
+	f.result = metadata
+	close(f.done)
+	return nil
+}
+
+// metadataConn 是可以回应 ut_metadata 请求的 peer 连接
+// 通过 readPeerMessage 读取时，会从对方的扩展握手中记录对方的 ut_metadata 扩展ID，
+// 并直接回应对方发给我们的元数据请求：有元数据时回复 data 消息，没有或块序号超出范围时回复 reject 消息
+type metadataConn struct {
+	net.Conn
+	metadata        []byte // 校验过的 info 字典的原始字节，nil 表示我们还没有元数据
+	peerExtensionID byte   // 对方的 ut_metadata 扩展ID，0 表示还没有收到对方的扩展握手或对方不支持
+}
+
+// newMetadataConn 包装一个 peer 连接，metadata 为 nil 时拒绝对方的所有元数据请求
+func newMetadataConn(conn net.Conn, metadata []byte) *metadataConn {
+	return &metadataConn{Conn: conn, metadata: metadata}
+}
+
+// handleExtensionMessage 处理一条扩展消息（payload 不含消息ID 20），返回 true 表示这条消息已经处理完
+// 扩展握手只记录对方的扩展ID，仍然返回给调用者；发给我们的 data、reject 消息也返回给调用者
+func (c *metadataConn) handleExtensionMessage(payload []byte) (bool, error) {
+	if len(payload) == 0 {
+		return false, nil
+	}
+	switch payload[0] {
+	case 0:
+		var handshake extensionHandshake
+		if Unmarshal(payload[1:], &handshake) == nil {
+			c.peerExtensionID = 0
+			if id := handshake.M["ut_metadata"]; id > 0 && id <= 255 {
+				c.peerExtensionID = byte(id)
+			}
+		}
+		return false, nil
+	case ourMetadataExtensionID:
+		message, _, err := parseMetadataMessage(payload[1:])
+		if err != nil || message.MsgType != metadataMsgRequest {
+			return false, nil
+		}
+		return true, c.answerMetadataRequest(message.Piece)
+	}
+	return false, nil
+}
+
+// answerMetadataRequest 回应对方对第 piece 块元数据的请求
+func (c *metadataConn) answerMetadataRequest(piece int) error {
+	if c.peerExtensionID == 0 {
+		// 不知道对方的扩展ID，无法回复
+		return nil
+	}
+	reply := metadataMessage{MsgType: metadataMsgReject, Piece: piece}
+	var data []byte
+	numPieces := (len(c.metadata) + metadataPieceSize - 1) / metadataPieceSize
+	if piece >= 0 && piece < numPieces {
+		start := piece * metadataPieceSize
+		data = c.metadata[start:min(start+metadataPieceSize, len(c.metadata))]
+		reply = metadataMessage{MsgType: metadataMsgData, Piece: piece, TotalSize: len(c.metadata)}
+	}
+	message, err := buildMetadataMessage(c.peerExtensionID, reply, data)
+	if err != nil {
+		return err
+	}
+	_, err = c.Write(message)
+	if err != nil {
+		return fmt.Errorf("error sending metadata piece: %v", err)
+	}
+	return nil
+}
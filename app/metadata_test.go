@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha1"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// 下载时对方在 piece 消息之间发来的 ut_metadata 请求由 metadataConn 回应，
+// 其他非 piece 消息（keep-alive、have、bitfield、不认识的扩展消息）被 receivePiece 跳过
+func TestServeMetadataDuringDownload(t *testing.T) {
+	const peerExtensionID = 3
+	metadata := bytes.Repeat([]byte("0123456789"), 2000) // 两块：16384 + 3616 字节
+	tests := []struct {
+		name     string
+		metadata []byte
+		piece    int
+		msgType  int
+		data     []byte
+	}{
+		{"first piece", metadata, 0, metadataMsgData, metadata[:metadataPieceSize]},
+		{"last piece", metadata, 1, metadataMsgData, metadata[metadataPieceSize:]},
+		{"piece out of range", metadata, 2, metadataMsgReject, nil},
+		{"negative piece", metadata, -1, metadataMsgReject, nil},
+		{"no metadata yet", nil, 0, metadataMsgReject, nil},
+	}
+	for _, test := range tests {
+		local, remote := net.Pipe()
+		local.SetDeadline(time.Now().Add(5 * time.Second))
+		remote.SetDeadline(time.Now().Add(5 * time.Second))
+		conn := newMetadataConn(local, test.metadata)
+
+		type result struct {
+			index, begin int
+			block        []byte
+			err          error
+		}
+		results := make(chan result, 1)
+		go func() {
+			index, begin, block, err := receivePiece(conn)
+			results <- result{index, begin, block, err}
+		}()
+
+		// 对方先发送扩展握手，然后请求一块元数据
+		handshake, _ := buildExtensionHandshakeMessage(peerExtensionID, 0)
+		remote.Write(handshake)
+		request, _ := buildMetadataRequestMessage(ourMetadataExtensionID, test.piece)
+		remote.Write(request)
+
+		messageID, payload, err := readRawPeerMessage(remote)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if messageID != 20 || len(payload) == 0 || payload[0] != peerExtensionID {
+			t.Fatalf("%s: expected a ut_metadata reply, got message %d %q", test.name, messageID, payload)
+		}
+		reply, data, err := parseMetadataMessage(payload[1:])
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if reply.MsgType != test.msgType || reply.Piece != test.piece || !bytes.Equal(data, test.data) {
+			t.Fatalf("%s: got reply %+v with %d bytes", test.name, reply, len(data))
+		}
+		if test.msgType == metadataMsgData && reply.TotalSize != len(metadata) {
+			t.Fatalf("%s: total_size %d, expected %d", test.name, reply.TotalSize, len(metadata))
+		}
+
+		// 其他消息之后才是 piece 消息
+		remote.Write([]byte{0, 0, 0, 0})
+		remote.Write(buildPeerMessage(4, []byte{0, 0, 0, 1}))
+		remote.Write(buildPeerMessage(5, []byte{0xff}))
+		remote.Write(buildPeerMessage(20, []byte{9, 'x'}))
+		remote.Write(buildPeerMessage(7, []byte{0, 0, 0, 5, 0, 0, 0x40, 0, 'a', 'b', 'c'}))
+		got := <-results
+		if got.err != nil {
+			t.Fatalf("%s: %v", test.name, got.err)
+		}
+		if got.index != 5 || got.begin != 16384 || string(got.block) != "abc" {
+			t.Fatalf("%s: got piece %d at %d: %q", test.name, got.index, got.begin, got.block)
+		}
+		local.Close()
+		remote.Close()
+	}
+}
+
+// startTestPeers 启动 peers，返回它们的地址
+func startTestPeers(t *testing.T, peers ...*testPeer) []Address {
+	t.Helper()
+	var addresses []Address
+	for _, peer := range peers {
+		address, err := parsePeerAddress(peer.start(t))
+		if err != nil {
+			t.Fatal(err)
+		}
+		addresses = append(addresses, address)
+	}
+	return addresses
+}
+
+// fetchTestMetadata 用 metadataFetcher 从 addresses 获取元数据，校验时与 expected 的 SHA-1 比较
+func fetchTestMetadata(expected []byte, timeout time.Duration, addresses []Address) ([]byte, error) {
+	hash := sha1.Sum(expected)
+	fetcher := newMetadataFetcher(func(data []byte) error {
+		if sha1.Sum(data) != hash {
+			return errors.New("metadata hash mismatch")
+		}
+		return nil
+	}, false)
+	fetcher.timeout = timeout
+	return fetcher.fetch(addresses, hash[:], make([]byte, 20))
+}
+
+// testMetadata 返回 size 字节的随机元数据
+func testMetadata(t *testing.T, size int) []byte {
+	t.Helper()
+	metadata := make([]byte, size)
+	if _, err := rand.Read(metadata); err != nil {
+		t.Fatal(err)
+	}
+	return metadata
+}
+
+func TestFetchMetadataReject(t *testing.T) {
+	metadata := testMetadata(t, 20000)
+	// 没有元数据的 peer 拒绝所有请求，换用下一个 peer
+	rejecting := &testPeer{}
+	_, err := fetchTestMetadata(metadata, time.Second, startTestPeers(t, rejecting))
+	if err == nil || !strings.Contains(err.Error(), "rejected") {
+		t.Fatalf("expected a reject error, got %v", err)
+	}
+	got, err := fetchTestMetadata(metadata, time.Second, startTestPeers(t, &testPeer{}, &testPeer{metadata: metadata}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, metadata) {
+		t.Fatal("fetched metadata differs")
+	}
+}
+
+func TestFetchMetadataTimeout(t *testing.T) {
+	metadata := testMetadata(t, 20000)
+	// 对方一直发送 keep-alive 但不回复请求：超时从请求发出时开始计算，不会被 keep-alive 延长
+	addresses := startTestPeers(t, &testPeer{metadata: metadata, silent: true})
+	result := make(chan error, 1)
+	start := time.Now()
+	go func() {
+		_, err := fetchTestMetadata(metadata, 200*time.Millisecond, addresses)
+		result <- err
+	}()
+	select {
+	case err := <-result:
+		if err == nil || !strings.Contains(err.Error(), "timeout") {
+			t.Fatalf("expected a timeout error, got %v", err)
+		}
+		if elapsed := time.Since(start); elapsed < 200*time.Millisecond {
+			t.Fatalf("gave up after %v, before the timeout", elapsed)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("keep-alive messages extended the timeout")
+	}
+}
+
+func TestFetchMetadataHashMismatch(t *testing.T) {
+	metadata := testMetadata(t, 40000)
+	corrupted := bytes.Clone(metadata)
+	corrupted[len(corrupted)-1] ^= 0xff
+
+	_, err := fetchTestMetadata(metadata, time.Second, startTestPeers(t, &testPeer{metadata: corrupted}))
+	if err == nil || !strings.Contains(err.Error(), "mismatch") {
+		t.Fatalf("expected a hash mismatch error, got %v", err)
+	}
+
+	// 校验失败的 peer 被放弃，改用其他 peer 的块
+	bad := &testPeer{metadata: corrupted}
+	good := &testPeer{metadata: metadata}
+	got, err := fetchTestMetadata(metadata, time.Second, startTestPeers(t, bad, good))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, metadata) {
+		t.Fatal("fetched metadata differs")
+	}
+}
+
+func TestFetchMetadataParallel(t *testing.T) {
+	metadata := testMetadata(t, 8*metadataPieceSize+100)
+	// 每个请求都要等一会才回复，一个 peer 不能很快发完所有块，块分散到多个 peer 上
+	peers := []*testPeer{
+		{metadata: metadata, delay: 20 * time.Millisecond},
+		{metadata: metadata, delay: 20 * time.Millisecond},
+		{metadata: metadata, delay: 20 * time.Millisecond},
+	}
+	got, err := fetchTestMetadata(metadata, time.Second, startTestPeers(t, peers...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, metadata) {
+		t.Fatal("fetched metadata differs")
+	}
+	serving := 0
+	for _, peer := range peers {
+		if peer.metadataRequests.Load() > 0 {
+			serving++
+		}
+	}
+	if serving < 2 {
+		t.Fatalf("only %d peer was asked for metadata pieces", serving)
+	}
+}
@@ -0,0 +1,646 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strings"
+)
+
+// Metainfo 是解析并校验过的 torrent 文件（BEP 3）
+// torrent 文件只在 loadMetainfo 中解析和校验一次，之后各个命令都直接使用这里的字段，
+// 不再重复对 map[string]interface{} 做类型断言
+type Metainfo struct {
+	Announce string `bencode:"announce,omitempty"`
+
+	// AnnounceList 是 BEP 12 的多层 tracker 列表，存在时优先于 announce
+	AnnounceList [][]string `bencode:"announce-list,omitempty"`
+
+	// URLList 是 BEP 19 的 web seed 列表，可能是字符串或字符串列表，解析结果在 WebSeeds 中
+	URLList  RawBencode `bencode:"url-list,omitempty"`
+	WebSeeds []string   `bencode:"-"`
+
+	Comment      string `bencode:"comment,omitempty"`
+	CreatedBy    string `bencode:"created by,omitempty"`
+	CreationDate int64  `bencode:"creation date,omitempty"` // Unix 时间戳
+
+	// InfoBytes 是文件中 info 字典的原始字节，info hash 就是对它计算的
+	InfoBytes RawBencode `bencode:"info"`
+
+	// PieceLayers 是 v2 torrent 的 piece 层哈希（BEP 52）：pieces root -> 连接在一起的 SHA-256 哈希
+	// 只有长度超过 piece length 的文件才有对应的项
+	PieceLayers map[string][]byte `bencode:"piece layers,omitempty"`
+
+	Info       InfoDict `bencode:"-"` // 解析后的 info 字典
+	InfoHash   [20]byte `bencode:"-"` // SHA-1(InfoBytes)
+	InfoHashV2 [32]byte `bencode:"-"` // SHA-256(InfoBytes)，只有 v2 torrent 才有
+
+	trackers *TrackerTiers // 由 announceTiers 在第一次请求 peer 时创建
+}
+
+// announceTiers 返回这个 torrent 在整个会话中共用的 TrackerTiers，第一次调用时根据 announce 和 announce-list 创建
+// 每次请求 peer 都使用同一个实例，BEP 12 中把响应的 tracker 移到层级最前面的效果才能保留下来
+func (meta *Metainfo) announceTiers() *TrackerTiers {
+	if meta.trackers == nil {
+		meta.trackers = newTrackerTiers(meta.Announce, meta.AnnounceList)
+	}
+	return meta.trackers
+}
+
+// InfoDict 是 torrent 的 info 字典，torrent 文件和通过 ut_metadata 获取的元数据共用这个类型
+// v1：单文件 torrent 使用 length，多文件 torrent 使用 files，两者只能出现一个
+// v2（BEP 52）：meta version 为 2，文件布局在 file tree 中，每个文件有自己的 merkle 树根
+type InfoDict struct {
+	Name        string     `bencode:"name"`
+	PieceLength int64      `bencode:"piece length"`
+	Pieces      []byte     `bencode:"pieces,omitempty"` // 连接在一起的 SHA-1 哈希，每个 20 字节
+	Length      int64      `bencode:"length,omitempty"`
+	FileList    []FileDict `bencode:"files,omitempty"`
+	Private     bool       `bencode:"private,omitempty"` // 私有 torrent（BEP 27），编码为 private=1；非零值都按私有处理
+
+	MetaVersion int64      `bencode:"meta version,omitempty"`
+	FileTree    RawBencode `bencode:"file tree,omitempty"`
+
+	// V2Files 是从 file tree 解析出的文件列表，顺序与 file tree 中的顺序（按键排序）一致
+	V2Files []V2File `bencode:"-"`
+}
+
+// V2File 是 v2 torrent 的 file tree 中的一个文件
+type V2File struct {
+	Path       []string // file tree 中的路径分量，不包含 name
+	Length     int64
+	PiecesRoot [32]byte // 文件 merkle 树的根，空文件没有
+
+	// PieceLayer 是文件的 piece 层哈希，来自顶层的 piece layers
+	// 长度不超过 piece length 的文件只有一个 piece，它的哈希就是 PiecesRoot，这里为空
+	PieceLayer [][32]byte
+}
+
+// fileTreeEntry 是 file tree 中文件节点 "" 键下的字典
+type fileTreeEntry struct {
+	Length     int64  `bencode:"length"`
+	PiecesRoot []byte `bencode:"pieces root,omitempty"`
+}
+
+// FileDict 是多文件 torrent 中 info.files 列表的一项
+type FileDict struct {
+	Length int64    `bencode:"length"`
+	Path   []string `bencode:"path"`           // 路径分量，最后一个是文件名
+	Attr   string   `bencode:"attr,omitempty"` // 文件属性（BEP 47），"p" 表示填充文件
+}
+
+// IsPadding 判断是否是填充文件（BEP 47）
+// 填充文件的内容全部为零，只用来让下一个文件从 piece 边界开始，不需要写到磁盘上
+func (file FileDict) IsPadding() bool {
+	return strings.Contains(file.Attr, "p")
+}
+
+// FileEntry 是 torrent 中的一个文件
+// Path 是相对于下载目录的路径分量：单文件 torrent 是 [name]，多文件 torrent 以 name 作为顶层目录
+// Offset 是文件在 piece 数据流中的起始偏移：v1 中文件首尾相连，v2 中每个文件都从 piece 边界开始
+type FileEntry struct {
+	Path   []string
+	Length int64
+	Offset int64
+}
+
+// loadMetainfo 以宽松模式加载 torrent 文件
+func loadMetainfo(torrentFile string) (*Metainfo, error) {
+	return loadMetainfoWithMode(torrentFile, BencodeLenient)
+}
+
+// loadMetainfoWithMode 按指定模式加载并校验 torrent 文件
+func loadMetainfoWithMode(torrentFile string, mode BencodeMode) (*Metainfo, error) {
+	file, err := os.Open(torrentFile)
+	if err != nil {
+		return nil, fmt.Errorf("error reading file: %v", err)
+	}
+	defer file.Close()
+
+	// 边读边解析，不需要先把整个文件读入内存
+	decoder := NewBencodeDecoder(file)
+	decoder.Mode = mode
+	node, err := decoder.Decode()
+	if err == io.EOF {
+		return nil, fmt.Errorf("error decoding bencoded string: torrent file is empty")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error decoding bencoded string: %v", err)
+	}
+	err = decoder.ExpectEOF(node)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding bencoded string: %v", err)
+	}
+	return parseMetainfo(node)
+}
+
+// parseMetainfo 从解码得到的顶层节点构建 Metainfo
+func parseMetainfo(node *BencodeNode) (*Metainfo, error) {
+	if node.Kind != 'd' {
+		return nil, errors.New("error: decoded value is not a dictionary")
+	}
+	info := node.Get("info")
+	if info == nil {
+		return nil, errors.New("'info' key not found")
+	}
+	if info.Kind != 'd' {
+		return nil, errors.New("'info' value is not a dictionary")
+	}
+
+	var meta Metainfo
+	err := unmarshalBencodeNode(node, &meta)
+	if err != nil {
+		return nil, err
+	}
+	infoDict, err := parseInfoDict(info)
+	if err != nil {
+		return nil, err
+	}
+	meta.Info = *infoDict
+	meta.WebSeeds = parseURLList(node.Get("url-list"))
+
+	// 直接对文件中 info 字典的原始字节做 SHA-1，而不是把解码后的字典重新编码：
+	// 重新编码只有在原文件完全符合规范（键已排序、整数无前导零等）时才能得到相同的字节，
+	// 对非规范或带有未知键的 torrent 会得到错误的 info hash
+	meta.InfoHash = sha1.Sum(meta.InfoBytes)
+	if meta.Info.IsV2() {
+		meta.InfoHashV2 = sha256.Sum256(meta.InfoBytes)
+		// 混合 torrent 可以只用 v1 的 SHA-1 校验，缺少 piece layers 时不报错
+		err = meta.Info.setPieceLayers(meta.PieceLayers, !meta.Info.HasV1())
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &meta, nil
+}
+
+// SwarmInfoHash 返回 tracker 请求和握手中使用的 20 字节 info hash
+// 包含 v1 信息的 torrent 使用 SHA-1 info hash，纯 v2 torrent 使用截断到 20 字节的 SHA-256 info hash
+func (meta *Metainfo) SwarmInfoHash() []byte {
+	return meta.SwarmInfoHashes()[0]
+}
+
+// SwarmInfoHashes 返回 torrent 可以加入的所有 swarm 的 info hash
+// 混合 torrent 同时属于 v1 和 v2 两个 swarm，v1 在前
+func (meta *Metainfo) SwarmInfoHashes() [][]byte {
+	var hashes [][]byte
+	if meta.Info.HasV1() {
+		hashes = append(hashes, meta.InfoHash[:])
+	}
+	if meta.Info.IsV2() {
+		hashes = append(hashes, meta.InfoHashV2[:20])
+	}
+	return hashes
+}
+
+// parseInfoBytes 解析一段完整的 info 字典（例如通过 ut_metadata 获取并校验过哈希的元数据）
+func parseInfoBytes(data []byte) (*InfoDict, error) {
+	node, err := decodeBencodeBytes(data, BencodeLenient)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding metadata content: %v", err)
+	}
+	if node.Kind != 'd' {
+		return nil, errors.New("error: metadata content is not a dictionary")
+	}
+	return parseInfoDict(node)
+}
+
+// parseInfoDict 解码并校验 info 字典
+func parseInfoDict(node *BencodeNode) (*InfoDict, error) {
+	var info InfoDict
+	err := unmarshalBencodeNode(node, &info)
+	if err != nil {
+		return nil, err
+	}
+
+	if node.Get("piece length") == nil {
+		return nil, errors.New("'piece length' key not found in info")
+	}
+	// piece 内的偏移和长度在 request/piece 消息里是 32 位的
+	if info.PieceLength <= 0 || info.PieceLength > math.MaxUint32 {
+		return nil, fmt.Errorf("'piece length' value %d is out of range", info.PieceLength)
+	}
+
+	if node.Get("meta version") != nil && info.MetaVersion != 2 {
+		return nil, fmt.Errorf("unsupported 'meta version' %d", info.MetaVersion)
+	}
+	if info.IsV2() {
+		if node.Get("file tree") == nil {
+			return nil, errors.New("'file tree' key not found in info")
+		}
+		err = info.parseFileTree(node.Get("file tree"))
+		if err != nil {
+			return nil, err
+		}
+	}
+	// 纯 v2 torrent 没有 v1 的键，其余情况按 v1 校验
+	if info.HasV1() {
+		err = info.validateV1(node)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if info.IsHybrid() {
+		err = info.validateHybrid()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &info, nil
+}
+
+// validateHybrid 校验混合 torrent 的 v1 和 v2 文件布局是否一致
+// v1 的文件列表需要用填充文件让每个文件都从 piece 边界开始，这样两种哈希才能对应同样的 piece
+func (info *InfoDict) validateHybrid() error {
+	v1Files := info.Files()
+	v2Files := (&InfoDict{Name: info.Name, PieceLength: info.PieceLength, MetaVersion: 2, V2Files: info.V2Files}).Files()
+	if len(v1Files) != len(v2Files) {
+		return fmt.Errorf("hybrid torrent has %d v1 files but %d v2 files", len(v1Files), len(v2Files))
+	}
+	for i := range v1Files {
+		v1, v2 := v1Files[i], v2Files[i]
+		if strings.Join(v1.Path, "/") != strings.Join(v2.Path, "/") || v1.Length != v2.Length {
+			return fmt.Errorf("hybrid torrent file %d differs between v1 (%q, %d bytes) and v2 (%q, %d bytes)",
+				i, strings.Join(v1.Path, "/"), v1.Length, strings.Join(v2.Path, "/"), v2.Length)
+		}
+		if v1.Length > 0 && v1.Offset != v2.Offset {
+			return fmt.Errorf("hybrid torrent file %q is not aligned to a piece boundary in v1 (missing padding file?)", strings.Join(v1.Path, "/"))
+		}
+	}
+	numPieces := 0
+	for _, file := range info.V2Files {
+		numPieces += int((file.Length + info.PieceLength - 1) / info.PieceLength)
+	}
+	if info.NumPieces() != numPieces {
+		return fmt.Errorf("hybrid torrent has %d v1 pieces but %d v2 pieces", info.NumPieces(), numPieces)
+	}
+	return nil
+}
+
+// validateV1 校验 v1 的 pieces、length 和 files
+func (info *InfoDict) validateV1(node *BencodeNode) error {
+	if node.Get("pieces") == nil {
+		return errors.New("'pieces' key not found in info")
+	}
+	// 单文件 torrent 有 length，多文件 torrent 有 files，必须且只能有一个
+	hasLength, hasFiles := node.Get("length") != nil, node.Get("files") != nil
+	if hasLength == hasFiles {
+		if hasLength {
+			return errors.New("info has both 'length' and 'files' keys")
+		}
+		return errors.New("'length' or 'files' key not found in info")
+	}
+	if hasFiles {
+		if len(info.FileList) == 0 {
+			return errors.New("'files' list is empty")
+		}
+		var total int64
+		for i, file := range info.FileList {
+			if file.Length < 0 {
+				return fmt.Errorf("files[%d]: 'length' value %d is negative", i, file.Length)
+			}
+			if len(file.Path) == 0 {
+				return fmt.Errorf("files[%d]: 'path' is empty", i)
+			}
+			// 总长度不能溢出 int64
+			if total > math.MaxInt64-file.Length {
+				return errors.New("total length of files overflows int64")
+			}
+			total += file.Length
+		}
+	}
+
+	if info.Length < 0 {
+		return fmt.Errorf("'length' value %d is negative", info.Length)
+	}
+	totalLength := info.dataLength()
+	if len(info.Pieces)%20 != 0 {
+		return fmt.Errorf("'pieces' length %d is not a multiple of 20", len(info.Pieces))
+	}
+	// piece 数量必须正好覆盖全部数据
+	expectedPieces := totalLength / info.PieceLength
+	if totalLength%info.PieceLength != 0 {
+		expectedPieces++
+	}
+	if int64(len(info.Pieces)/20) != expectedPieces {
+		return fmt.Errorf("'pieces' has %d hashes, expected %d for %d bytes", len(info.Pieces)/20, expectedPieces, totalLength)
+	}
+	return nil
+}
+
+// parseFileTree 解析 v2 的 file tree
+// 目录是以文件名为键的字典，文件是只有一个空字符串键的字典：{"": {"length": ..., "pieces root": ...}}
+func (info *InfoDict) parseFileTree(tree *BencodeNode) error {
+	// v2 要求 piece length 是 2 的幂且不小于一个 block
+	if info.PieceLength < merkleBlockSize || info.PieceLength&(info.PieceLength-1) != 0 {
+		return fmt.Errorf("'piece length' value %d must be a power of two and at least %d for v2 torrents", info.PieceLength, merkleBlockSize)
+	}
+	if tree.Kind != 'd' {
+		return errors.New("'file tree' value is not a dictionary")
+	}
+	var total int64
+	var walk func(node *BencodeNode, path []string) error
+	walk = func(node *BencodeNode, path []string) error {
+		if node.Kind != 'd' {
+			return fmt.Errorf("file tree: %q is not a dictionary", strings.Join(path, "/"))
+		}
+		if entryNode := node.Get(""); entryNode != nil {
+			if len(path) == 0 || len(node.Keys) != 1 {
+				return fmt.Errorf("file tree: invalid file entry at %q", strings.Join(path, "/"))
+			}
+			var entry fileTreeEntry
+			err := unmarshalBencodeNode(entryNode, &entry)
+			if err != nil {
+				return fmt.Errorf("file tree: %q: %v", strings.Join(path, "/"), err)
+			}
+			file := V2File{Path: append([]string(nil), path...), Length: entry.Length}
+			if entry.Length < 0 {
+				return fmt.Errorf("file tree: %q: 'length' value %d is negative", strings.Join(path, "/"), entry.Length)
+			}
+			// 非空文件必须有 32 字节的 pieces root
+			if entry.Length > 0 {
+				if len(entry.PiecesRoot) != 32 {
+					return fmt.Errorf("file tree: %q: 'pieces root' must be 32 bytes", strings.Join(path, "/"))
+				}
+				copy(file.PiecesRoot[:], entry.PiecesRoot)
+			}
+			if total > math.MaxInt64-entry.Length {
+				return errors.New("total length of files overflows int64")
+			}
+			total += entry.Length
+			info.V2Files = append(info.V2Files, file)
+			return nil
+		}
+		if len(node.Keys) == 0 && len(path) > 0 {
+			return fmt.Errorf("file tree: directory %q is empty", strings.Join(path, "/"))
+		}
+		for _, key := range node.Keys {
+			err := walk(node.Dict[key], append(path, key))
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	err := walk(tree, nil)
+	if err != nil {
+		return err
+	}
+	if len(info.V2Files) == 0 {
+		return errors.New("'file tree' is empty")
+	}
+	return nil
+}
+
+// setPieceLayers 从顶层的 piece layers 中取出每个文件的 piece 层哈希，并用 pieces root 校验
+// required 为 false 时（混合 torrent）允许缺少某个文件的 piece 层，但给出的 piece 层仍然必须正确
+func (info *InfoDict) setPieceLayers(layers map[string][]byte, required bool) error {
+	blocksPerPiece := int(info.PieceLength / merkleBlockSize)
+	pad := merklePadHash(blocksPerPiece)
+	for i := range info.V2Files {
+		file := &info.V2Files[i]
+		if file.Length <= info.PieceLength {
+			continue // 只有一个 piece，直接用 pieces root 校验
+		}
+		layer, ok := layers[string(file.PiecesRoot[:])]
+		if !ok && !required {
+			continue
+		}
+		if !ok {
+			return fmt.Errorf("piece layer for %q not found in 'piece layers'", strings.Join(file.Path, "/"))
+		}
+		numPieces := int((file.Length + info.PieceLength - 1) / info.PieceLength)
+		if len(layer) != numPieces*32 {
+			return fmt.Errorf("piece layer for %q has %d bytes, expected %d", strings.Join(file.Path, "/"), len(layer), numPieces*32)
+		}
+		hashes := make([][32]byte, numPieces)
+		for j := range hashes {
+			copy(hashes[j][:], layer[j*32:])
+		}
+		// piece 层补齐到 2 的幂后计算出的树根必须等于 pieces root
+		if merkleRoot(hashes, nextPowerOfTwo(numPieces), pad) != file.PiecesRoot {
+			return fmt.Errorf("piece layer for %q does not match its pieces root", strings.Join(file.Path, "/"))
+		}
+		file.PieceLayer = hashes
+	}
+	return nil
+}
+
+// IsV2 判断 info 字典是否包含 v2 信息（纯 v2 或混合 torrent）
+func (info *InfoDict) IsV2() bool {
+	return info.MetaVersion == 2
+}
+
+// HasV1 判断 info 字典是否包含 v1 信息（纯 v1 或混合 torrent）
+func (info *InfoDict) HasV1() bool {
+	return !info.IsV2() || len(info.Pieces) > 0
+}
+
+// IsHybrid 判断是否是同时包含 v1 和 v2 信息的混合 torrent
+func (info *InfoDict) IsHybrid() bool {
+	return info.IsV2() && len(info.Pieces) > 0
+}
+
+// IsMultiFile 判断是否是多文件 torrent
+// 纯 v2 torrent 的 file tree 中只有一个与 name 同名的顶层文件时视为单文件 torrent
+func (info *InfoDict) IsMultiFile() bool {
+	if !info.HasV1() {
+		return len(info.V2Files) != 1 || len(info.V2Files[0].Path) != 1 || info.V2Files[0].Path[0] != info.Name
+	}
+	return len(info.FileList) > 0
+}
+
+// TotalLength 返回 torrent 中所有数据的总长度（多文件 torrent 是所有文件长度之和，不包括填充文件）
+func (info *InfoDict) TotalLength() int64 {
+	var total int64
+	if !info.HasV1() {
+		for _, file := range info.V2Files {
+			total += file.Length
+		}
+		return total
+	}
+	if !info.IsMultiFile() {
+		return info.Length
+	}
+	for _, file := range info.FileList {
+		if !file.IsPadding() {
+			total += file.Length
+		}
+	}
+	return total
+}
+
+// dataLength 返回 v1 piece 数据流的长度，包括填充文件
+func (info *InfoDict) dataLength() int64 {
+	if !info.IsMultiFile() {
+		return info.Length
+	}
+	var total int64
+	for _, file := range info.FileList {
+		total += file.Length
+	}
+	return total
+}
+
+// Files 返回 torrent 的文件布局，顺序与数据在 pieces 中的顺序一致
+func (info *InfoDict) Files() []FileEntry {
+	if !info.HasV1() {
+		// v2 的每个文件都从新的 piece 开始
+		files := make([]FileEntry, 0, len(info.V2Files))
+		var offset int64
+		for _, file := range info.V2Files {
+			path := append([]string{info.Name}, file.Path...)
+			if !info.IsMultiFile() {
+				path = file.Path
+			}
+			files = append(files, FileEntry{Path: path, Length: file.Length, Offset: offset})
+			offset += (file.Length + info.PieceLength - 1) / info.PieceLength * info.PieceLength
+		}
+		return files
+	}
+	if !info.IsMultiFile() {
+		return []FileEntry{{Path: []string{info.Name}, Length: info.Length}}
+	}
+	// 填充文件不返回，但仍然占据数据流中的位置
+	files := make([]FileEntry, 0, len(info.FileList))
+	var offset int64
+	for _, file := range info.FileList {
+		if !file.IsPadding() {
+			path := append([]string{info.Name}, file.Path...)
+			files = append(files, FileEntry{Path: path, Length: file.Length, Offset: offset})
+		}
+		offset += file.Length
+	}
+	return files
+}
+
+// NumPieces 返回 piece 的数量
+func (info *InfoDict) NumPieces() int {
+	if !info.HasV1() {
+		numPieces := 0
+		for _, file := range info.V2Files {
+			numPieces += int((file.Length + info.PieceLength - 1) / info.PieceLength)
+		}
+		return numPieces
+	}
+	return len(info.Pieces) / 20
+}
+
+// PieceHashes 返回每个 piece 的 v1 SHA-1 哈希（纯 v2 torrent 返回空）
+func (info *InfoDict) PieceHashes() [][20]byte {
+	hashes := make([][20]byte, len(info.Pieces)/20)
+	for i := range hashes {
+		copy(hashes[i][:], info.Pieces[i*20:])
+	}
+	return hashes
+}
+
+// PieceSize 返回指定 piece 的实际长度
+// v1：最后一个 piece 的长度 = 总长度 - (pieceIndex * pieceLength)，可能小于 piece length
+// v2：piece 不会跨越文件，每个文件的最后一个 piece 都可能小于 piece length
+func (info *InfoDict) PieceSize(pieceIndex int) (int, error) {
+	if pieceIndex < 0 || pieceIndex >= info.NumPieces() {
+		return 0, fmt.Errorf("piece index %d out of range", pieceIndex)
+	}
+	// 偏移按 64 位计算，超过 4 GiB 的文件也不会溢出
+	start := int64(pieceIndex) * info.PieceLength
+	if !info.HasV1() {
+		file, _, err := info.v2PieceFile(pieceIndex)
+		if err != nil {
+			return 0, err
+		}
+		return int(min(info.PieceLength, file.Offset+file.Length-start)), nil
+	}
+	pieceLength := info.PieceLength
+	totalLength := info.dataLength()
+	if start+pieceLength > totalLength {
+		// 这是最后一个 piece
+		pieceLength = totalLength - start
+	}
+	return int(pieceLength), nil
+}
+
+// VerifyPiece 校验下载到的 piece
+// 有 v1 信息时校验 SHA-1；有 v2 信息时再用 merkle 树校验（混合 torrent 两者都要通过）
+// 混合 torrent 缺少 piece 层时（例如通过 ut_metadata 获取的元数据）只校验 SHA-1
+func (info *InfoDict) VerifyPiece(pieceIndex int, data []byte) error {
+	pieceLength, err := info.PieceSize(pieceIndex)
+	if err != nil {
+		return err
+	}
+	if len(data) != pieceLength {
+		return fmt.Errorf("piece %d has %d bytes, expected %d", pieceIndex, len(data), pieceLength)
+	}
+	if info.HasV1() {
+		hash := sha1.Sum(data)
+		if !bytes.Equal(hash[:], info.Pieces[pieceIndex*20:pieceIndex*20+20]) {
+			return errors.New("piece hash verification failed")
+		}
+	}
+	if info.IsV2() {
+		return info.verifyPieceV2(pieceIndex, data)
+	}
+	return nil
+}
+
+// verifyPieceV2 用文件的 merkle 树校验 piece
+func (info *InfoDict) verifyPieceV2(pieceIndex int, data []byte) error {
+	hash, v2File, indexInFile, err := info.v2PieceHash(pieceIndex, data)
+	if err != nil {
+		return err
+	}
+	expected := v2File.PiecesRoot
+	if v2File.Length > info.PieceLength {
+		if len(v2File.PieceLayer) == 0 && info.HasV1() {
+			// 混合 torrent 已经校验过 SHA-1
+			return nil
+		}
+		if len(v2File.PieceLayer) == 0 {
+			return fmt.Errorf("piece layer for %q is not available", strings.Join(v2File.Path, "/"))
+		}
+		expected = v2File.PieceLayer[indexInFile]
+	}
+	if hash != expected {
+		return errors.New("piece merkle root verification failed")
+	}
+	return nil
+}
+
+// v2PieceHash 计算 piece 在文件 merkle 树中对应节点的哈希，返回所在的文件和 piece 在文件中的序号
+// 多个 piece 的文件：叶子补齐到一个完整 piece 的 block 数，结果是 piece 层中的一项
+// 只有一个 piece 的文件：叶子补齐到 2 的幂，结果就是文件的 pieces root
+func (info *InfoDict) v2PieceHash(pieceIndex int, data []byte) ([32]byte, *V2File, int, error) {
+	file, v2File, err := info.v2PieceFile(pieceIndex)
+	if err != nil {
+		return [32]byte{}, nil, 0, err
+	}
+	start := int64(pieceIndex) * info.PieceLength
+	// 混合 torrent 的 v1 piece 可能包含文件后面的填充数据，v2 只对文件本身的数据计算哈希
+	end := min(int64(len(data)), file.Offset+file.Length-start)
+	leaves := merkleLeafHashes(data[:end])
+	width := int(info.PieceLength / merkleBlockSize)
+	if v2File.Length <= info.PieceLength {
+		width = nextPowerOfTwo(len(leaves))
+	}
+	indexInFile := int((start - file.Offset) / info.PieceLength)
+	return merkleRoot(leaves, width, [32]byte{}), v2File, indexInFile, nil
+}
+
+// v2PieceFile 找到 piece 所在的文件，返回它在数据流中的布局和 file tree 中的信息
+func (info *InfoDict) v2PieceFile(pieceIndex int) (FileEntry, *V2File, error) {
+	start := int64(pieceIndex) * info.PieceLength
+	var offset int64
+	for i := range info.V2Files {
+		file := &info.V2Files[i]
+		if file.Length > 0 && start >= offset && start < offset+file.Length {
+			return FileEntry{Path: file.Path, Length: file.Length, Offset: offset}, file, nil
+		}
+		offset += (file.Length + info.PieceLength - 1) / info.PieceLength * info.PieceLength
+	}
+	return FileEntry{}, nil, fmt.Errorf("piece index %d out of range", pieceIndex)
+}
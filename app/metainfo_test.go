@@ -0,0 +1,187 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha1"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeTestFiles 在 root 下写入随机内容的文件，返回每个文件的内容
+func writeTestFiles(t *testing.T, root string, sizes map[string]int) map[string][]byte {
+	t.Helper()
+	data := make(map[string][]byte, len(sizes))
+	for name, size := range sizes {
+		content := make([]byte, size)
+		rand.Read(content)
+		path := filepath.Join(root, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, content, 0644); err != nil {
+			t.Fatal(err)
+		}
+		data[name] = content
+	}
+	return data
+}
+
+// reparseTorrent 编码 meta 后按读取 torrent 文件的方式重新解析
+func reparseTorrent(t *testing.T, meta *Metainfo) (*Metainfo, error) {
+	t.Helper()
+	encoded, err := Marshal(meta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	node, err := decodeBencodeBytes(encoded, BencodeLenient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return parseMetainfo(node)
+}
+
+func TestHybridWithoutPieceLayers(t *testing.T) {
+	root := filepath.Join(t.TempDir(), "hybrid")
+	writeTestFiles(t, root, map[string]int{"a": 100000, "sub/b": 70000, "sub/c": 5000})
+	created, err := createTorrent(CreateOptions{Path: root, PieceLength: 16384, Hybrid: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(created.PieceLayers) == 0 {
+		t.Fatal("expected piece layers for files larger than the piece length")
+	}
+
+	// 去掉 piece layers，相当于通过 ut_metadata 获取的元数据
+	created.PieceLayers = nil
+	meta, err := reparseTorrent(t, created)
+	if err != nil {
+		t.Fatalf("hybrid torrent without piece layers rejected: %v", err)
+	}
+	if !meta.Info.IsHybrid() || meta.InfoHash != created.InfoHash || meta.InfoHashV2 != created.InfoHashV2 {
+		t.Fatal("info hashes changed")
+	}
+
+	report, err := verifyData(meta, root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.OK() {
+		t.Fatalf("good data failed verification: %d bad, %d missing", report.Bad, report.Missing)
+	}
+
+	// 只用 SHA-1 校验时，损坏的数据仍然会被发现
+	path := filepath.Join(root, "a")
+	content, _ := os.ReadFile(path)
+	content[0] ^= 0xff
+	os.WriteFile(path, content, 0644)
+	report, err = verifyData(meta, root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Bad != 1 {
+		t.Fatalf("expected 1 bad piece, got %d", report.Bad)
+	}
+
+	// 通过 ut_metadata 获取的 info 字典同样可以校验
+	info, err := parseInfoBytes(meta.InfoBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content[0] ^= 0xff
+	if err := info.VerifyPiece(0, content[:16384]); err != nil {
+		t.Fatalf("piece 0: %v", err)
+	}
+}
+
+func TestHybridWithWrongPieceLayer(t *testing.T) {
+	root := filepath.Join(t.TempDir(), "hybrid")
+	writeTestFiles(t, root, map[string]int{"a": 100000, "b": 5000})
+	created, err := createTorrent(CreateOptions{Path: root, PieceLength: 16384, Hybrid: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 给出的 piece 层仍然必须与 pieces root 一致
+	for key, layer := range created.PieceLayers {
+		corrupted := append([]byte{}, layer...)
+		corrupted[0] ^= 0xff
+		created.PieceLayers[key] = corrupted
+	}
+	if _, err := reparseTorrent(t, created); err == nil {
+		t.Fatal("expected an error for a piece layer that does not match its pieces root")
+	}
+}
+
+// 不规范但可以解析的 torrent：info hash 必须是文件中 info 字典原始字节的 SHA-1，而不是重新编码后的
+func TestInfoHashOfUnusualTorrents(t *testing.T) {
+	pieces := "6:pieces20:" + strings.Repeat("\x01", 20)
+	tests := []struct {
+		name   string
+		before string // info 字典之前的内容（包括 "d" 和 "4:info"）
+		info   string
+		after  string // info 字典之后的内容（包括结尾的 "e"）
+		length int64
+	}{
+		{
+			name:   "unsorted info keys",
+			before: "d8:announce9:http://x/4:info",
+			info:   "d" + pieces + "4:name1:a6:lengthi10e12:piece lengthi16384ee",
+			after:  "e",
+			length: 10,
+		},
+		{
+			name:   "unsorted top-level keys",
+			before: "d4:info",
+			info:   "d6:lengthi10e4:name1:a12:piece lengthi16384e" + pieces + "e",
+			after:  "7:comment2:hi8:announce9:http://x/e",
+			length: 10,
+		},
+		{
+			name:   "unknown keys with binary content",
+			before: "d8:announce9:http://x/4:info",
+			info:   "d3:\xff\x00\x014:\x00\xfe\xff\x806:lengthi10e4:name1:a12:piece lengthi16384e" + pieces + "7:x-extrad1:kl4:\xc3\x28\x00\x00eee",
+			after:  "3:\x80\x81\x82i1ee",
+			length: 10,
+		},
+		{
+			name:   "non-canonical integers",
+			before: "d4:info",
+			info:   "d6:lengthi0010e4:name01:a12:piece lengthi016384e" + pieces + "7:privatei-0ee",
+			after:  "e",
+			length: 10,
+		},
+		{
+			name:   "unknown keys in file list",
+			before: "d4:info",
+			info:   "d5:filesld6:md5sum16:" + strings.Repeat("\xaa", 16) + "6:lengthi4e4:pathl1:xeed4:ed2k3:\x00\x01\x026:lengthi6e4:pathl1:yeee4:name1:d12:piece lengthi16384e" + pieces + "e",
+			after:  "e",
+			length: 10,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "unusual.torrent")
+			if err := os.WriteFile(path, []byte(test.before+test.info+test.after), 0644); err != nil {
+				t.Fatal(err)
+			}
+			meta, err := loadMetainfo(path)
+			if err != nil {
+				t.Fatalf("valid torrent rejected: %v", err)
+			}
+			if string(meta.InfoBytes) != test.info {
+				t.Fatalf("info bytes %q, expected %q", meta.InfoBytes, test.info)
+			}
+			if meta.InfoHash != sha1.Sum([]byte(test.info)) {
+				t.Fatalf("info hash %x is not the SHA-1 of the raw info dictionary", meta.InfoHash)
+			}
+			if meta.Info.TotalLength() != test.length {
+				t.Fatalf("total length %d, expected %d", meta.Info.TotalLength(), test.length)
+			}
+			// 严格模式拒绝这些文件，说明它们确实不规范
+			if _, err := loadMetainfoWithMode(path, BencodeStrict); err == nil {
+				t.Fatal("strict mode accepted a non-canonical torrent")
+			}
+		})
+	}
+}
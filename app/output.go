@@ -0,0 +1,193 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// --json 模式的输出结构
+// 字段名和类型是给脚本使用的稳定接口，只增加字段，不修改或删除已有字段；
+// 二进制值（info hash、piece 哈希、peer id、保留字节）都输出为小写十六进制字符串
+
+// TorrentInfoJSON 是 info 和 magnet_info 命令的输出
+type TorrentInfoJSON struct {
+	TrackerURL   string     `json:"tracker_url"`
+	AnnounceList [][]string `json:"announce_list"`
+	Length       int64      `json:"length"`
+	InfoHash     string     `json:"info_hash,omitempty"`    // v1 info hash，纯 v2 torrent 没有
+	InfoHashV2   string     `json:"info_hash_v2,omitempty"` // v2 info hash（完整的 SHA-256），纯 v1 torrent 没有
+	PieceLength  int64      `json:"piece_length"`
+	PieceHashes  []string   `json:"piece_hashes"` // v1 的 piece 哈希，纯 v2 torrent 为空数组
+	Files        []FileJSON `json:"files"`        // 单文件 torrent 也输出一项，路径就是 name
+	Private      bool       `json:"private"`      // 私有 torrent（BEP 27）
+}
+
+// FileJSON 是 torrent 中的一个文件，路径以 name 开头、用 "/" 连接
+type FileJSON struct {
+	Path   string `json:"path"`
+	Length int64  `json:"length"`
+}
+
+// PeersJSON 是 peers 命令的输出
+type PeersJSON struct {
+	Peers []PeerJSON `json:"peers"`
+}
+
+// PeerJSON 是一个 peer 的地址
+type PeerJSON struct {
+	IP   string `json:"ip"`
+	Port int    `json:"port"`
+}
+
+// HandshakeJSON 是 handshake 和 magnet_handshake 命令的输出
+type HandshakeJSON struct {
+	PeerID             string         `json:"peer_id"`
+	Reserved           string         `json:"reserved"` // 对方握手中的 8 个保留字节
+	SupportsExtensions bool           `json:"supports_extensions"`
+	Extensions         map[string]int `json:"extensions"` // 扩展名 -> 对方的扩展消息 ID，没有进行扩展握手时为空对象
+}
+
+// MagnetLinkJSON 是 magnet_parse 命令的输出
+type MagnetLinkJSON struct {
+	InfoHash    string     `json:"info_hash"`              // btih，纯 v2 磁力链接为空字符串
+	TrackerURL  string     `json:"tracker_url"`            // 第一个 tr，没有时为空字符串
+	InfoHashV2  string     `json:"info_hash_v2,omitempty"` // btmh 中的 SHA-256
+	DisplayName string     `json:"display_name"`
+	Length      int64      `json:"length"` // xl，0 表示未知
+	Trackers    []string   `json:"trackers"`
+	WebSeeds    []string   `json:"web_seeds"`
+	Peers       []PeerJSON `json:"peers"`
+	SelectOnly  []int      `json:"select_only"`
+}
+
+// ErrorJSON 是 --json 模式下所有命令出错时的输出
+type ErrorJSON struct {
+	Error ErrorDetailJSON `json:"error"`
+}
+
+// ErrorDetailJSON 描述出错的命令和错误信息
+type ErrorDetailJSON struct {
+	Command string `json:"command"`
+	Message string `json:"message"`
+}
+
+// parseJSONFlag 从参数中取出 --json，返回是否输出 JSON 和剩余参数
+func parseJSONFlag(args []string) (bool, []string) {
+	jsonMode := false
+	rest := make([]string, 0, len(args))
+	for _, arg := range args {
+		if arg == "--json" {
+			jsonMode = true
+		} else {
+			rest = append(rest, arg)
+		}
+	}
+	return jsonMode, rest
+}
+
+// printJSON 把 value 编码为一行 JSON 输出到标准输出
+func printJSON(value interface{}) {
+	output, err := json.Marshal(value)
+	if err != nil {
+		exitWithJSONError("json", fmt.Errorf("error encoding json output: %v", err))
+	}
+	fmt.Println(string(output))
+}
+
+// exitWithJSONError 以 ErrorJSON 的格式输出错误，并以非零状态码退出
+func exitWithJSONError(command string, err error) {
+	output, _ := json.Marshal(ErrorJSON{Error: ErrorDetailJSON{Command: command, Message: err.Error()}})
+	fmt.Println(string(output))
+	os.Exit(1)
+}
+
+// exitWithError 输出错误并以非零状态码退出，jsonMode 时使用 ErrorJSON 的格式
+func exitWithError(command string, jsonMode bool, err error) {
+	if jsonMode {
+		exitWithJSONError(command, err)
+	}
+	fmt.Println(err)
+	os.Exit(1)
+}
+
+// checkArgs 检查位置参数的数量，不足时输出用法并以非零状态码退出，jsonMode 时使用 ErrorJSON 的格式
+func checkArgs(command string, jsonMode bool, args []string, count int, usage string) {
+	if len(args) < count {
+		exitWithError(command, jsonMode, errors.New("usage: "+usage))
+	}
+}
+
+// newTorrentInfoJSON 把已加载的 torrent 转换为 info 命令的 JSON 输出
+func newTorrentInfoJSON(meta *Metainfo) TorrentInfoJSON {
+	info := &meta.Info
+	result := TorrentInfoJSON{
+		TrackerURL:   meta.Announce,
+		AnnounceList: meta.AnnounceList,
+		Length:       info.TotalLength(),
+		PieceLength:  info.PieceLength,
+		PieceHashes:  []string{},
+		Files:        []FileJSON{},
+		Private:      info.Private,
+	}
+	if result.AnnounceList == nil {
+		result.AnnounceList = [][]string{}
+	}
+	if info.HasV1() {
+		result.InfoHash = hex.EncodeToString(meta.InfoHash[:])
+		for _, pieceHash := range info.PieceHashes() {
+			result.PieceHashes = append(result.PieceHashes, hex.EncodeToString(pieceHash[:]))
+		}
+	}
+	if info.IsV2() {
+		result.InfoHashV2 = hex.EncodeToString(meta.InfoHashV2[:])
+	}
+	for _, file := range info.Files() {
+		result.Files = append(result.Files, FileJSON{Path: strings.Join(file.Path, "/"), Length: file.Length})
+	}
+	return result
+}
+
+// newPeersJSON 把 peer 地址列表转换为 peers 命令的 JSON 输出
+func newPeersJSON(peers []Address) PeersJSON {
+	result := PeersJSON{Peers: make([]PeerJSON, 0, len(peers))}
+	for _, peer := range peers {
+		result.Peers = append(result.Peers, PeerJSON{IP: peer.IP, Port: peer.Port})
+	}
+	return result
+}
+
+// newHandshakeJSON 把握手结果转换为 handshake 命令的 JSON 输出
+func newHandshakeJSON(peer *PeerHandshake) HandshakeJSON {
+	result := HandshakeJSON{
+		PeerID:             hex.EncodeToString(peer.PeerID),
+		Reserved:           hex.EncodeToString(peer.Reserved),
+		SupportsExtensions: supportsExtensions(peer.Reserved),
+		Extensions:         peer.Extensions,
+	}
+	if result.Extensions == nil {
+		result.Extensions = map[string]int{}
+	}
+	return result
+}
+
+// newMagnetLinkJSON 把解析后的磁力链接转换为 magnet_parse 命令的 JSON 输出
+func newMagnetLinkJSON(magnet *Magnet) MagnetLinkJSON {
+	result := MagnetLinkJSON{
+		InfoHash:    magnet.InfoHashHex(),
+		TrackerURL:  magnet.TrackerURL(),
+		DisplayName: magnet.DisplayName,
+		Length:      magnet.Length,
+		Trackers:    append([]string{}, magnet.Trackers...),
+		WebSeeds:    append([]string{}, magnet.WebSeeds...),
+		Peers:       newPeersJSON(magnet.Peers).Peers,
+		SelectOnly:  append([]int{}, magnet.SelectOnly...),
+	}
+	if magnet.HasV2 {
+		result.InfoHashV2 = hex.EncodeToString(magnet.InfoHashV2[:])
+	}
+	return result
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/bits"
+	"net"
+	"time"
+)
+
+// v2 的 hash 消息（BEP 52）：向 peer 请求文件 merkle 树中某一层的一段哈希
+// 通过 ut_metadata 获取的元数据不包含顶层的 piece layers，纯 v2 torrent 需要用它们取回每个文件的 piece 层
+const (
+	msgHashRequest = 21
+	msgHashes      = 22
+	msgHashReject  = 23
+)
+
+// maxHashesPerRequest 是一个 hash request 最多请求的哈希数量
+const maxHashesPerRequest = 512
+
+// hashRequest 是 hash request / hashes / hash reject 消息共同的头部
+type hashRequest struct {
+	PiecesRoot  [32]byte
+	BaseLayer   uint32 // 0 是叶子层（16 KiB block），piece 层是 log2(piece length / 16 KiB)
+	Index       uint32 // 第一个哈希在这一层中的序号，必须是 Length 的整数倍
+	Length      uint32 // 哈希数量，2 的幂且不小于 2
+	ProofLayers uint32 // 需要附带的证明层数，我们直接用 pieces root 校验整层，总是 0
+}
+
+// encode 编码为 48 字节的消息头部
+func (r hashRequest) encode() []byte {
+	payload := make([]byte, 48)
+	copy(payload, r.PiecesRoot[:])
+	binary.BigEndian.PutUint32(payload[32:], r.BaseLayer)
+	binary.BigEndian.PutUint32(payload[36:], r.Index)
+	binary.BigEndian.PutUint32(payload[40:], r.Length)
+	binary.BigEndian.PutUint32(payload[44:], r.ProofLayers)
+	return payload
+}
+
+// parseHashRequest 解析消息头部，返回头部和后面的数据
+func parseHashRequest(payload []byte) (hashRequest, []byte, error) {
+	var r hashRequest
+	if len(payload) < 48 {
+		return r, nil, fmt.Errorf("hash message too short: %d bytes", len(payload))
+	}
+	copy(r.PiecesRoot[:], payload)
+	r.BaseLayer = binary.BigEndian.Uint32(payload[32:])
+	r.Index = binary.BigEndian.Uint32(payload[36:])
+	r.Length = binary.BigEndian.Uint32(payload[40:])
+	r.ProofLayers = binary.BigEndian.Uint32(payload[44:])
+	return r, payload[48:], nil
+}
+
+// missingPieceLayers 返回需要 piece 层但还没有的文件（长度超过 piece length 的 v2 文件）
+func (info *InfoDict) missingPieceLayers() []*V2File {
+	var files []*V2File
+	for i := range info.V2Files {
+		file := &info.V2Files[i]
+		if file.Length > info.PieceLength && len(file.PieceLayer) == 0 {
+			files = append(files, file)
+		}
+	}
+	return files
+}
+
+// fetchPieceLayers 向磁力链接的 peer 请求所有缺少的 piece 层，返回与 torrent 文件中 piece layers 格式相同的结果
+// 每一层都用文件的 pieces root 校验；一个 peer 拒绝、超时或返回错误的哈希时换下一个 peer
+func fetchPieceLayers(magnet *Magnet, info *InfoDict) (map[string][]byte, error) {
+	files := info.missingPieceLayers()
+	if len(files) == 0 {
+		return nil, nil
+	}
+	peerID := make([]byte, 20)
+	_, err := rand.Read(peerID)
+	if err != nil {
+		return nil, fmt.Errorf("error generating peer id: %v", err)
+	}
+	addresses, err := magnet.requestPeers(peerID, info)
+	if err != nil {
+		return nil, err
+	}
+
+	layers := make(map[string][]byte, len(files))
+	for _, address := range addresses {
+		conn, _, err := magnetHandshakeWithPeer(address, magnet.SwarmInfoHash(), peerID, nil, info.IsV2())
+		if err != nil {
+			continue
+		}
+		for _, file := range files {
+			if _, ok := layers[string(file.PiecesRoot[:])]; ok {
+				continue
+			}
+			layer, err := requestPieceLayer(conn, info, file)
+			if err != nil {
+				break
+			}
+			layers[string(file.PiecesRoot[:])] = layer
+		}
+		conn.Close()
+		if len(layers) == len(files) {
+			return layers, nil
+		}
+	}
+	return nil, fmt.Errorf("error: no peer provided the piece layers for %d of %d files", len(files)-len(layers), len(files))
+}
+
+// requestPieceLayer 通过一个连接请求文件的整个 piece 层，用 pieces root 校验后返回连接在一起的哈希
+// piece 层补齐到 2 的幂后按每次最多 maxHashesPerRequest 个哈希请求，补齐部分由对方一起返回
+func requestPieceLayer(conn net.Conn, info *InfoDict, file *V2File) ([]byte, error) {
+	blocksPerPiece := int(info.PieceLength / merkleBlockSize)
+	numPieces := int((file.Length + info.PieceLength - 1) / info.PieceLength)
+	width := nextPowerOfTwo(numPieces)
+	chunk := min(width, maxHashesPerRequest)
+	baseLayer := uint32(bits.TrailingZeros(uint(blocksPerPiece)))
+
+	hashes := make([][32]byte, 0, width)
+	for index := 0; index < width; index += chunk {
+		request := hashRequest{PiecesRoot: file.PiecesRoot, BaseLayer: baseLayer, Index: uint32(index), Length: uint32(chunk)}
+		_, err := conn.Write(buildPeerMessage(msgHashRequest, request.encode()))
+		if err != nil {
+			return nil, fmt.Errorf("error sending hash request: %v", err)
+		}
+		// 每个请求的超时从发出请求时开始计算，跳过的其他消息不会延长超时
+		conn.SetReadDeadline(time.Now().Add(magnetPeerTimeout))
+		for {
+			messageID, payload, err := readPeerMessage(conn)
+			if err != nil {
+				return nil, fmt.Errorf("error reading hashes: %v", err)
+			}
+			if messageID != msgHashes && messageID != msgHashReject {
+				continue
+			}
+			reply, data, err := parseHashRequest(payload)
+			if err != nil {
+				return nil, err
+			}
+			if reply != request {
+				continue // 其他请求的回复
+			}
+			if messageID == msgHashReject {
+				return nil, errors.New("error: peer rejected hash request")
+			}
+			if len(data) != chunk*32 {
+				return nil, fmt.Errorf("error: hashes message has %d bytes, expected %d", len(data), chunk*32)
+			}
+			for i := 0; i < chunk; i++ {
+				var hash [32]byte
+				copy(hash[:], data[i*32:])
+				hashes = append(hashes, hash)
+			}
+			break
+		}
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	// 补齐部分必须是全零 piece 子树的根，整层计算出的树根必须等于 pieces root
+	pad := merklePadHash(blocksPerPiece)
+	for _, hash := range hashes[numPieces:] {
+		if hash != pad {
+			return nil, errors.New("error: piece layer padding does not match")
+		}
+	}
+	if merkleRoot(hashes, width, pad) != file.PiecesRoot {
+		return nil, errors.New("error: piece layer does not match its pieces root")
+	}
+	var layer bytes.Buffer
+	for _, hash := range hashes[:numPieces] {
+		layer.Write(hash[:])
+	}
+	return layer.Bytes(), nil
+}
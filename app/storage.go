@@ -0,0 +1,197 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// FileStorage 把按 piece 编号的数据写到 torrent 描述的文件中
+// 所有文件按 torrent 中的顺序组成一个连续的数据流，piece 就是这个数据流上的定长切片，
+// v1 中文件首尾相连，一个 piece 可能跨越多个文件的边界，写入时需要拆分成多段；
+// v2 中每个文件都从 piece 边界开始，文件之间的空隙不对应任何文件（见 InfoDict.Files）
+type FileStorage struct {
+	info  *InfoDict
+	files []storageFile
+}
+
+// storageFile 是一个文件在磁盘上的位置，以及它在整个数据流中占据的范围
+type storageFile struct {
+	path   string
+	offset int64 // 该文件在数据流中的起始偏移
+	length int64
+}
+
+// fileSegment 是一段数据流落在某个文件中的部分
+type fileSegment struct {
+	file       *storageFile
+	fileOffset int64 // 在文件内的偏移
+	dataOffset int64 // 在要读写的数据中的偏移
+	length     int64
+}
+
+// newFileStorage 根据 info 字典计算每个文件在磁盘上的路径
+// 单文件 torrent：savePath 就是输出文件的路径
+// 多文件 torrent：savePath 是输出目录，相当于 torrent 的顶层目录（name），files 中的路径都在它下面
+func newFileStorage(info *InfoDict, savePath string) (*FileStorage, error) {
+	storage := &FileStorage{info: info}
+	for _, file := range info.Files() {
+		path := savePath
+		if info.IsMultiFile() {
+			// Path[0] 是 torrent 的 name，由 savePath 代替
+			joined, err := safeJoinPath(savePath, file.Path[1:])
+			if err != nil {
+				return nil, err
+			}
+			path = joined
+		}
+		storage.files = append(storage.files, storageFile{path: path, offset: file.Offset, length: file.Length})
+	}
+	return storage, nil
+}
+
+// safeJoinPath 把 torrent 中的路径分量拼接到 root 下
+// 路径来自不可信的元数据，必须保证结果不会跑到 root 之外（例如 ".."、绝对路径、包含分隔符的分量）
+func safeJoinPath(root string, components []string) (string, error) {
+	if len(components) == 0 {
+		return "", errors.New("invalid file path: path is empty")
+	}
+	for _, component := range components {
+		switch {
+		case component == "", component == ".", component == "..":
+			return "", fmt.Errorf("invalid file path component %q", component)
+		case strings.ContainsAny(component, "/\\\x00"):
+			return "", fmt.Errorf("invalid file path component %q", component)
+		case filepath.VolumeName(component) != "":
+			return "", fmt.Errorf("invalid file path component %q", component)
+		}
+	}
+	return filepath.Join(append([]string{root}, components...)...), nil
+}
+
+// Create 创建目录结构和所有文件，并把每个文件截断/扩展到它在 torrent 中的长度
+func (s *FileStorage) Create() error {
+	for _, file := range s.files {
+		err := os.MkdirAll(filepath.Dir(file.path), 0755)
+		if err != nil {
+			return fmt.Errorf("error creating directory: %v", err)
+		}
+		f, err := os.OpenFile(file.path, os.O_RDWR|os.O_CREATE, 0644)
+		if err != nil {
+			return fmt.Errorf("error creating file: %v", err)
+		}
+		err = f.Truncate(file.length)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("error resizing file: %v", err)
+		}
+	}
+	return nil
+}
+
+// segments 把数据流上 [offset, offset+length) 的范围拆分为落在各个文件中的片段
+func (s *FileStorage) segments(offset int64, length int64) []fileSegment {
+	var segments []fileSegment
+	end := offset + length
+	for i := range s.files {
+		file := &s.files[i]
+		fileEnd := file.offset + file.length
+		if fileEnd <= offset || file.offset >= end || file.length == 0 {
+			continue
+		}
+		start := max(offset, file.offset)
+		stop := min(end, fileEnd)
+		segments = append(segments, fileSegment{
+			file:       file,
+			fileOffset: start - file.offset,
+			dataOffset: start - offset,
+			length:     stop - start,
+		})
+	}
+	return segments
+}
+
+// WritePiece 把一个完整的 piece 写到它覆盖的所有文件中
+func (s *FileStorage) WritePiece(pieceIndex int, data []byte) error {
+	pieceLength, err := s.info.PieceSize(pieceIndex)
+	if err != nil {
+		return err
+	}
+	if len(data) != pieceLength {
+		return fmt.Errorf("piece %d has %d bytes, expected %d", pieceIndex, len(data), pieceLength)
+	}
+	offset := int64(pieceIndex) * s.info.PieceLength
+	for _, segment := range s.segments(offset, int64(len(data))) {
+		f, err := os.OpenFile(segment.file.path, os.O_WRONLY, 0644)
+		if err != nil {
+			return fmt.Errorf("error opening file: %v", err)
+		}
+		_, err = f.WriteAt(data[segment.dataOffset:segment.dataOffset+segment.length], segment.fileOffset)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("error writing file: %v", err)
+		}
+	}
+	return nil
+}
+
+// ReadAt 从数据流的 offset 处读取 len(p) 字节，可能跨越多个文件
+// 不属于任何文件的部分（填充文件、v2 中文件之间的空隙）读出为零
+// 文件不存在或长度不足时返回错误
+func (s *FileStorage) ReadAt(p []byte, offset int64) (int, error) {
+	clear(p)
+	segments := s.segments(offset, int64(len(p)))
+	expected, n := 0, 0
+	for _, segment := range segments {
+		expected += int(segment.length)
+	}
+	for _, segment := range segments {
+		f, err := os.Open(segment.file.path)
+		if err != nil {
+			return n, fmt.Errorf("error opening file: %v", err)
+		}
+		read, err := f.ReadAt(p[segment.dataOffset:segment.dataOffset+segment.length], segment.fileOffset)
+		f.Close()
+		n += read
+		if err != nil {
+			return n, fmt.Errorf("error reading file %s: %v", segment.file.path, err)
+		}
+	}
+	if n != expected {
+		return n, io.ErrUnexpectedEOF
+	}
+	return len(p), nil
+}
+
+// HasRange 判断数据流上 [offset, offset+length) 范围涉及的文件是否都存在且长度足够
+func (s *FileStorage) HasRange(offset int64, length int64) bool {
+	for _, segment := range s.segments(offset, length) {
+		stat, err := os.Stat(segment.file.path)
+		if err != nil || !stat.Mode().IsRegular() || stat.Size() < segment.fileOffset+segment.length {
+			return false
+		}
+	}
+	return true
+}
+
+// WritePieces 创建所有文件，然后按文件布局写出下载好的全部 pieces
+func (s *FileStorage) WritePieces(pieces map[int][]byte) error {
+	err := s.Create()
+	if err != nil {
+		return err
+	}
+	for pieceIndex := 0; pieceIndex < s.info.NumPieces(); pieceIndex++ {
+		data, ok := pieces[pieceIndex]
+		if !ok {
+			return fmt.Errorf("piece %d is missing", pieceIndex)
+		}
+		err = s.WritePiece(pieceIndex, data)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -2,303 +2,154 @@ package main
 
 import (
 	"crypto/rand"
-	"crypto/sha1"
 	"encoding/hex"
 	"errors"
 	"fmt"
 	"net"
-	"net/http"
-	"net/url"
-	"os"
-	"strconv"
 	"strings"
-	"sync"
 )
 
-// TODO 使用结构体去存储torrent的元数据
-
-func getInfoFromTorrentFile(torrentFile string) string {
-	torrentDict, err := getTorrentFileDict(torrentFile)
+// getInfoFromTorrentFile 实现 info 命令，mode 决定按严格还是宽松模式解析 torrent 文件
+func getInfoFromTorrentFile(torrentFile string, mode BencodeMode) string {
+	meta, err := loadMetainfoWithMode(torrentFile, mode)
 	if err != nil {
-		return fmt.Sprintf("Error getting torrent file dict: %v", err)
-	}
-	// 提取 announce (tracker URL)
-	announce, ok := torrentDict["announce"]
-	if !ok {
-		return "Error: 'announce' key not found"
+		return fmt.Sprintf("Error loading torrent file: %v", err)
 	}
-	announceStr, ok := announce.(string)
-	if !ok {
-		return "Error: 'announce' value is not a string"
+	// info hash 已经根据文件中 info 字典的原始字节计算
+	// 纯 v2 torrent 没有 v1 的 info hash 和 piece 哈希，只输出 v2 的 info hash
+	var response strings.Builder
+	response.WriteString(fmt.Sprintf("Tracker URL: %s\nLength: %d", meta.Announce, meta.Info.TotalLength()))
+	if meta.Info.HasV1() {
+		response.WriteString(fmt.Sprintf("\nInfo Hash: %s", hex.EncodeToString(meta.InfoHash[:])))
 	}
-
-	// 提取 info 字典
-	info, ok := torrentDict["info"]
-	if !ok {
-		return "Error: 'info' key not found"
+	if meta.Info.IsV2() {
+		response.WriteString(fmt.Sprintf("\nInfo Hash v2: %s", hex.EncodeToString(meta.InfoHashV2[:])))
 	}
-	infoDict, ok := info.(map[string]interface{})
-	if !ok {
-		return "Error: 'info' value is not a dictionary"
-	}
-
-	// 提取 length
-	length, ok := infoDict["length"]
-	if !ok {
-		return "Error: 'length' key not found in info"
+	response.WriteString(fmt.Sprintf("\nPiece Length: %d", meta.Info.PieceLength))
+	if meta.Info.HasV1() {
+		response.WriteString(fmt.Sprintf("\nPiece Hashes: %x", meta.Info.Pieces))
 	}
-	lengthInt, ok := length.(int)
-	if !ok {
-		return "Error: 'length' value is not an integer"
-	}
-
-	// 处理 pieces 字段：如果是 string，转换为 []byte 以保持原始字节
-	infoDictForEncoding := make(map[string]interface{})
-	for k, v := range infoDict {
-		if k == "pieces" {
-			// pieces 必须是字节数组
-			if piecesStr, ok := v.(string); ok {
-				infoDictForEncoding[k] = []byte(piecesStr)
-			} else if piecesBytes, ok := v.([]byte); ok {
-				infoDictForEncoding[k] = piecesBytes
-			} else {
-				return "Error: 'pieces' value has invalid type"
-			}
-		} else {
-			infoDictForEncoding[k] = v
-		}
+	// 私有 torrent（BEP 27）只从 tracker 获取 peer
+	if meta.Info.Private {
+		response.WriteString("\nPrivate: yes")
 	}
+	return response.String() + formatFileList(&meta.Info)
+}
 
-	// 编码 info 字典
-	encodedInfo, err := encodeBencode(infoDictForEncoding)
-	if err != nil {
-		return fmt.Sprintf("Error encoding info dictionary: %v", err)
-	}
-
-	// 计算 SHA-1 哈希
-	hash := sha1.Sum([]byte(encodedInfo))
-	infoHash := fmt.Sprintf("%x", hash)
-
-	// 获取Piece Length
-	pieceLength, ok := infoDict["piece length"]
-	if !ok {
-		return "Error: 'piece length' key not found in info"
-	}
-	pieceLengthInt, ok := pieceLength.(int)
-	if !ok {
-		return "Error: 'piece length' value is not an integer"
+// formatFileList 格式化多文件 torrent 的文件列表（每行一个文件的路径和长度），单文件 torrent 返回空字符串
+func formatFileList(info *InfoDict) string {
+	if !info.IsMultiFile() {
+		return ""
 	}
-	// 获取Piece Hashes
-	pieceHashes, ok := infoDict["pieces"]
-	if !ok {
-		return "Error: 'pieces' key not found in info"
-	}
-	pieceHashesStr, ok := pieceHashes.(string)
-	if !ok {
-		return "Error: 'pieces' value is not a string"
+	var result strings.Builder
+	result.WriteString("\nFiles:")
+	for _, file := range info.Files() {
+		result.WriteString(fmt.Sprintf("\n%s (%d bytes)", strings.Join(file.Path, "/"), file.Length))
 	}
-	// 格式化输出
-	return fmt.Sprintf("Tracker URL: %s\nLength: %d\nInfo Hash: %s\nPiece Length: %d\nPiece Hashes: %x", announceStr, lengthInt, infoHash, pieceLengthInt, pieceHashesStr)
+	return result.String()
 }
 
 func getPeerAddress(torrentFile string) (string, []Address) {
-	torrentDict, err := getTorrentFileDict(torrentFile)
+	meta, err := loadMetainfo(torrentFile)
 	if err != nil {
-		return fmt.Sprintf("Error getting torrent file dict: %v", err), nil
+		return fmt.Sprintf("Error loading torrent file: %v", err), nil
 	}
-	return getPeerAddressFromDict(torrentDict)
+	return getPeerAddressFromMetainfo(meta)
 }
 
-// getPeerAddressFromDict 从已解析的 torrentDict 获取 peer 地址列表
-func getPeerAddressFromDict(torrentDict map[string]interface{}) (string, []Address) {
+// errNoTrackers 表示 torrent 中既没有 announce 也没有 announce-list
+var errNoTrackers = errors.New("'announce' key not found")
 
-	// 获取 announce URL
-	announce, ok := torrentDict["announce"]
-	if !ok {
-		return "Error: 'announce' key not found", nil
+// getPeerAddressFromMetainfo 向已加载的 torrent 的 tracker 请求 peer 地址列表，返回 peers 命令的输出和地址列表
+func getPeerAddressFromMetainfo(meta *Metainfo) (string, []Address) {
+	peersList, err := requestPeers(meta)
+	if err == errNoTrackers {
+		return "Error: " + err.Error(), nil
 	}
-	announceStr, ok := announce.(string)
-	if !ok {
-		return "Error: 'announce' value is not a string", nil
+	if err != nil {
+		return fmt.Sprintf("Error requesting peers from tracker: %v", err), nil
 	}
 
-	// 获取 info 字典
-	info, ok := torrentDict["info"]
-	if !ok {
-		return "Error: 'info' key not found", nil
-	}
-	infoDict, ok := info.(map[string]interface{})
-	if !ok {
-		return "Error: 'info' value is not a dictionary", nil
+	// 格式化输出 peer 地址，每行一个
+	lines := make([]string, 0, len(peersList))
+	for _, peer := range peersList {
+		lines = append(lines, fmt.Sprintf("%s:%d", peer.IP, peer.Port))
 	}
+	return strings.Join(lines, "\n"), peersList
+}
 
-	// 获取 length
-	length, ok := infoDict["length"]
-	if !ok {
-		return "Error: 'length' key not found in info", nil
-	}
-	lengthInt, ok := length.(int)
-	if !ok {
-		return "Error: 'length' value is not an integer", nil
+// requestPeers 向已加载的 torrent 的 tracker 请求 peer 地址列表
+// 存在 announce-list 时按 BEP 12 逐层尝试，某个 tracker 失败时自动切换到下一个；
+// 然后查询 DiscoveryPolicy 允许的其他来源（私有 torrent 只使用 tracker）
+func requestPeers(meta *Metainfo) ([]Address, error) {
+	discoverers := meta.Info.DiscoveryPolicy().discoverers()
+	trackers := meta.announceTiers()
+	if len(trackers.Tiers()) == 0 && len(discoverers) == 0 {
+		return nil, errNoTrackers
 	}
 
-	// 处理 pieces 字段：如果是 string，转换为 []byte 以保持原始字节
-	infoDictForEncoding := make(map[string]interface{})
-	for k, v := range infoDict {
-		if k == "pieces" {
-			if piecesStr, ok := v.(string); ok {
-				infoDictForEncoding[k] = []byte(piecesStr)
-			} else if piecesBytes, ok := v.([]byte); ok {
-				infoDictForEncoding[k] = piecesBytes
-			} else {
-				return "Error: 'pieces' value has invalid type", nil
+	// 混合 torrent 分别请求 v1 和 v2 两个 swarm 的 peer，合并去重
+	var peersList []Address
+	seen := make(map[Address]bool)
+	var lastErr error
+	addPeers := func(addresses []Address, err error) {
+		if err != nil {
+			lastErr = err
+			return
+		}
+		for _, address := range addresses {
+			if !seen[address] {
+				seen[address] = true
+				peersList = append(peersList, address)
 			}
-		} else {
-			infoDictForEncoding[k] = v
 		}
 	}
-
-	// 编码 info 字典
-	encodedInfo, err := encodeBencode(infoDictForEncoding)
-	if err != nil {
-		return fmt.Sprintf("Error encoding info dictionary: %v", err), nil
-	}
-
-	// 计算 SHA-1 哈希（20 字节的原始字节）
-	hash := sha1.Sum([]byte(encodedInfo))
-	infoHashBytes := hash[:] // 转换为 []byte
-
-	// 生成 peer_id（20 字节的唯一标识符）
-	peerID := []byte("-PC0001-123456789012") // 20 字节
-
-	// 构建完整 URL
-	trackerURL, err := url.Parse(announceStr)
-	if err != nil {
-		return fmt.Sprintf("error parsing tracker URL: %v", err), nil
-	}
-
-	// 手动构建查询字符串以确保 info_hash 和 peer_id 正确编码
-	queryParts := []string{
-		"info_hash=" + url.QueryEscape(string(infoHashBytes)),
-		"peer_id=" + url.QueryEscape(string(peerID)),
-		"port=6881",
-		"uploaded=0",
-		"downloaded=0",
-		"left=" + strconv.Itoa(lengthInt),
-		"compact=1",
-	}
-	trackerURL.RawQuery = strings.Join(queryParts, "&")
-
-	// 发送 HTTP GET 请求
-	resp, err := http.Get(trackerURL.String())
-	if err != nil {
-		return fmt.Sprintf("Error making request to tracker: %v", err), nil
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Sprintf("error: tracker returned status code %d", resp.StatusCode), nil
-	}
-
-	// 读取响应体
-	body := make([]byte, 0)
-	buf := make([]byte, 4096)
-	for {
-		n, err := resp.Body.Read(buf)
-		if n > 0 {
-			body = append(body, buf[:n]...)
+	for _, infoHash := range meta.SwarmInfoHashes() {
+		if len(trackers.Tiers()) > 0 {
+			addPeers(trackers.Announce(announceRequest{
+				InfoHash: infoHash,
+				PeerID:   []byte("-PC0001-123456789012"), // 20 字节的 peer_id
+				Left:     meta.Info.TotalLength(),
+			}))
 		}
-		if err != nil {
-			break
+		for _, discoverer := range discoverers {
+			addPeers(discoverer.Discover(&meta.Info, infoHash))
 		}
 	}
-
-	// 解析 bencoded 响应
-	responseStr := string(body)
-	decoded, _, err := decodeBencode(responseStr)
-	if err != nil {
-		return fmt.Sprintf("Error decoding tracker response: %v", err), nil
-	}
-
-	// 类型断言为字典
-	responseDict, ok := decoded.(map[string]interface{})
-	if !ok {
-		return "error: tracker response is not a dictionary", nil
-	}
-
-	// 提取 peers（紧凑格式：每个 peer 6 字节，前 4 字节是 IP，后 2 字节是端口）
-	peers, ok := responseDict["peers"]
-	if !ok {
-		return "error: 'peers' key not found in tracker response", nil
-	}
-
-	peersStr, ok := peers.(string)
-	if !ok {
-		return "error: 'peers' value is not a string", nil
-	}
-
-	// 解析 peers（紧凑格式）
-	peersBytes := []byte(peersStr)
-	if len(peersBytes)%6 != 0 {
-		return fmt.Sprintf("error: invalid peers format, length is %d (should be multiple of 6)", len(peersBytes)), nil
-	}
-
-	// 格式化输出 peer 地址
-	// 前四位是ip，后2为是端口
-	var result strings.Builder
-
-	var peersList []Address
-	for i := 0; i < len(peersBytes); i += 6 {
-		ip := fmt.Sprintf("%d.%d.%d.%d", peersBytes[i], peersBytes[i+1], peersBytes[i+2], peersBytes[i+3])
-		port := int(peersBytes[i+4])<<8 | int(peersBytes[i+5])
-		result.WriteString(fmt.Sprintf("%s:%d", ip, port))
-		peersList = append(peersList, Address{IP: ip, Port: port})
+	if len(peersList) == 0 && lastErr != nil {
+		return nil, lastErr
 	}
-
-	return result.String(), peersList
+	return peersList, nil
 }
 
-func getTorrentFileDict(torrentFile string) (map[string]interface{}, error) {
-	data, err := os.ReadFile(torrentFile)
-	if err != nil {
-		return nil, fmt.Errorf("error reading file: %v", err)
-	}
-	// 将字节转换为字符串（Go 的 string 可以包含任意字节）
-	bencodedString := string(data)
-
-	// 解析 bencoded 字典
-	decoded, _, err := decodeBencode(bencodedString)
+// handshake 实现 handshake 命令，返回对方的 peer id 或错误信息
+func handshake(torrentFile string, address string) string {
+	peer, err := peerHandshake(torrentFile, address)
 	if err != nil {
-		return nil, fmt.Errorf("error decoding bencoded string: %v", err)
+		return err.Error()
 	}
-
-	// 类型断言为字典
-	torrentDict, ok := decoded.(map[string]interface{})
-	if !ok {
-		return nil, fmt.Errorf("error: decoded value is not a dictionary")
-	}
-
-	return torrentDict, nil
+	return fmt.Sprintf("Peer ID: %s", hex.EncodeToString(peer.PeerID))
 }
 
-func handshake(torrentFile string, address string) string {
+// peerHandshake 与 address 处的 peer 完成 BitTorrent 握手（不进行扩展握手），返回对方的 peer id 和保留字节
+func peerHandshake(torrentFile string, address string) (*PeerHandshake, error) {
 	// 获取 info hash（20 字节原始字节）
 	infoHashBytes, err := getInfoHashBytes(torrentFile)
 	if err != nil {
-		return fmt.Sprintf("error getting info hash: %v", err)
+		return nil, fmt.Errorf("error getting info hash: %v", err)
 	}
 
 	// 生成随机 peer id（20 字节）
 	peerID := make([]byte, 20)
 	_, err = rand.Read(peerID)
 	if err != nil {
-		return fmt.Sprintf("error generating peer id: %v", err)
+		return nil, fmt.Errorf("error generating peer id: %v", err)
 	}
 
 	// 建立 TCP 连接
 	conn, err := net.Dial("tcp", address)
 	if err != nil {
-		return fmt.Sprintf("error connecting to peer: %v", err)
+		return nil, fmt.Errorf("error connecting to peer: %v", err)
 	}
 	defer conn.Close()
 
@@ -313,7 +164,7 @@ func handshake(torrentFile string, address string) string {
 	// 发送握手消息
 	_, err = conn.Write(handshakeMsg)
 	if err != nil {
-		return fmt.Sprintf("error sending handshake: %v", err)
+		return nil, fmt.Errorf("error sending handshake: %v", err)
 	}
 
 	// 接收握手响应（68 字节）
@@ -322,96 +173,56 @@ func handshake(torrentFile string, address string) string {
 	for totalRead < 68 {
 		n, err := conn.Read(response[totalRead:])
 		if err != nil {
-			return fmt.Sprintf("error receiving handshake: %v", err)
+			return nil, fmt.Errorf("error receiving handshake: %v", err)
 		}
 		totalRead += n
 	}
 
 	// 验证响应格式
 	if totalRead < 68 {
-		return fmt.Sprintf("error: handshake response too short, got %d bytes", totalRead)
+		return nil, fmt.Errorf("error: handshake response too short, got %d bytes", totalRead)
 	}
 
 	// 验证协议字符串长度
 	if response[0] != 19 {
-		return fmt.Sprintf("error: invalid protocol string length, got %d", response[0])
+		return nil, fmt.Errorf("error: invalid protocol string length, got %d", response[0])
 	}
 
 	// 验证协议字符串
 	protocolStr := string(response[1:20])
 	if protocolStr != "BitTorrent protocol" {
-		return fmt.Sprintf("error: invalid protocol string, got %s", protocolStr)
+		return nil, fmt.Errorf("error: invalid protocol string, got %s", protocolStr)
 	}
 
-	// 提取对方发送的 peer id（最后 20 字节）
-	receivedPeerID := response[48:68]
-
-	// 转换为十六进制字符串
-	peerIDHex := hex.EncodeToString(receivedPeerID)
-
-	return fmt.Sprintf("Peer ID: %s", peerIDHex)
+	// 保留字节（索引20-27）和对方发送的 peer id（最后 20 字节）
+	return &PeerHandshake{PeerID: response[48:68], Reserved: response[20:28]}, nil
 }
 
-// getInfoHashBytes 获取 info hash 的原始字节（20 字节）
+// getInfoHashBytes 获取握手使用的 info hash 原始字节（20 字节，纯 v2 torrent 是截断的 SHA-256）
 func getInfoHashBytes(torrentFile string) ([]byte, error) {
-	torrentDict, err := getTorrentFileDict(torrentFile)
+	meta, err := loadMetainfo(torrentFile)
 	if err != nil {
 		return nil, err
 	}
-	return getInfoHashBytesFromDict(torrentDict)
+	return meta.SwarmInfoHash(), nil
 }
 
-// getInfoHashBytesFromDict 从已解析的 torrentDict 获取 info hash 字节
-func getInfoHashBytesFromDict(torrentDict map[string]interface{}) ([]byte, error) {
-	// 获取 info 字典
-	info, ok := torrentDict["info"]
-	if !ok {
-		return nil, errors.New("'info' key not found")
-	}
-	infoDict, ok := info.(map[string]interface{})
-	if !ok {
-		return nil, errors.New("'info' value is not a dictionary")
-	}
-
-	// 处理 pieces 字段：如果是 string，转换为 []byte 以保持原始字节
-	infoDictForEncoding := make(map[string]interface{})
-	for k, v := range infoDict {
-		if k == "pieces" {
-			if piecesStr, ok := v.(string); ok {
-				infoDictForEncoding[k] = []byte(piecesStr)
-			} else {
-				return nil, errors.New("'pieces' value has invalid type")
-			}
-		} else {
-			infoDictForEncoding[k] = v
-		}
-	}
-
-	// 编码 info 字典
-	encodedInfo, err := encodeBencode(infoDictForEncoding)
+func downloadPiece(tag string, piecePath string, torrentFile string, pieceIndex int) ([]byte, error) {
+	// 只加载一次 torrent 文件
+	meta, err := loadMetainfo(torrentFile)
 	if err != nil {
-		return nil, fmt.Errorf("error encoding info dictionary: %v", err)
+		return nil, fmt.Errorf("error loading torrent file: %v", err)
 	}
-
-	// 计算 SHA-1 哈希（20 字节的原始字节）
-	hash := sha1.Sum([]byte(encodedInfo))
-	return hash[:], nil
-}
-
-func downloadPiece(tag string, piecePath string, torrentFile string, pieceIndex int) ([]byte, error) {
-	_, peersList := getPeerAddress(torrentFile)
+	_, peersList := getPeerAddressFromMetainfo(meta)
 	if len(peersList) == 0 {
 		return nil, fmt.Errorf("no peers found")
 	}
-	infoHashBytes, err := getInfoHashBytes(torrentFile)
-	if err != nil {
-		return nil, fmt.Errorf("error getting info hash: %v", err)
-	}
+	infoHashes := meta.SwarmInfoHashes()
 
 	// 尝试连接到每个 peer，直到成功
 	var conn net.Conn
 	for _, address := range peersList {
-		conn, err = performHandshakeWithPeer(address, infoHashBytes)
+		conn, err = performHandshakeWithSwarms(address, infoHashes, meta.InfoBytes, meta.Info.IsV2())
 		if err != nil {
 			continue // 尝试下一个 peer
 		}
@@ -447,21 +258,7 @@ func downloadPiece(tag string, piecePath string, torrentFile string, pieceIndex
 
 	defer conn.Close()
 
-	// 获取 info 字典
-	torrentDict, err := getTorrentFileDict(torrentFile)
-	if err != nil {
-		return nil, fmt.Errorf("error parsing torrent file: %v", err)
-	}
-	info, ok := torrentDict["info"]
-	if !ok {
-		return nil, fmt.Errorf("'info' key not found")
-	}
-	infoDict, ok := info.(map[string]interface{})
-	if !ok {
-		return nil, fmt.Errorf("'info' value is not a dictionary")
-	}
-
-	data, err := downloadPieceReuseConn(conn, infoDict, pieceIndex)
+	data, err := downloadPieceReuseConn(conn, &meta.Info, pieceIndex)
 	if err != nil {
 		return nil, fmt.Errorf("error downloading piece: %v", err)
 	}
@@ -476,8 +273,9 @@ func downloadPiece(tag string, piecePath string, torrentFile string, pieceIndex
 }
 
 // downloadPieceReuseConn 使用已建立的连接下载 piece（不保存到文件）
-func downloadPieceReuseConn(conn net.Conn, infoDict map[string]interface{}, pieceIndex int) ([]byte, error) {
-	pieceLength, pieceHash, err := getPieceInfoFromDict(infoDict, pieceIndex)
+// torrent 文件和磁力链接获取的元数据都使用这个函数
+func downloadPieceReuseConn(conn net.Conn, info *InfoDict, pieceIndex int) ([]byte, error) {
+	pieceLength, err := info.PieceSize(pieceIndex)
 	if err != nil {
 		return nil, fmt.Errorf("error getting piece info: %v", err)
 	}
@@ -561,119 +359,31 @@ func downloadPieceReuseConn(conn net.Conn, infoDict map[string]interface{}, piec
 		return nil, fmt.Errorf("error combining blocks: %v", err)
 	}
 
-	// 验证 piece 哈希
-	if !verifyPieceHash(piece, pieceHash[:]) {
-		return nil, fmt.Errorf("piece hash verification failed")
+	// 验证 piece 哈希（v1 的 SHA-1 或 v2 的 merkle 树）
+	err = info.VerifyPiece(pieceIndex, piece)
+	if err != nil {
+		return nil, err
 	}
 
 	return piece, nil
 }
 
-func download(savePath string, torrentFile string) error {
-	torrentDict, err := getTorrentFileDict(torrentFile)
-	if err != nil {
-		return fmt.Errorf("error parsing torrent file: %v", err)
-	}
-	piecesLen, dataLen, err := getTotalPiecesFromDict(torrentDict)
-	if err != nil {
-		return err
-	}
-	piecesMap := map[int][]byte{}
-	for i := 0; i < piecesLen; i++ {
-		pieceBytes, err := downloadPiece("", PieceFilesDir, torrentFile, i)
-		if err != nil {
-			return err
-		}
-		piecesMap[i] = pieceBytes
-	}
-	combinedFileData, err := combinePieces(piecesMap, dataLen)
-	if err != nil {
-		return err
-	}
-	err = os.WriteFile(savePath, combinedFileData, 0644)
-	if err != nil {
-		return fmt.Errorf("error writing combined file: %v", err)
-	}
-	return nil
-}
-
 func downloadFileConcurrent(torrentFile string, savePath string) error {
-	// 只解析一次 torrent 文件
-	torrentDict, err := getTorrentFileDict(torrentFile)
-	if err != nil {
-		return fmt.Errorf("error parsing torrent file: %v", err)
-	}
-
-	// 从已解析的 torrentDict 获取信息
-	piecesLen, dataLen, err := getTotalPiecesFromDict(torrentDict)
-	if err != nil {
-		return err
-	}
-	_, peerList := getPeerAddressFromDict(torrentDict)
-	if len(peerList) == 0 {
-		return fmt.Errorf("no peers found")
-	}
-	infoHashBytes, err := getInfoHashBytesFromDict(torrentDict)
-	if err != nil {
-		return err
-	}
-
-	// 获取 info 字典，传递给 workers
-	info, ok := torrentDict["info"]
-	if !ok {
-		return errors.New("'info' key not found")
-	}
-	infoDict, ok := info.(map[string]interface{})
-	if !ok {
-		return errors.New("'info' value is not a dictionary")
-	}
-
-	// 初始化工作队列
-	queue := &WorkQueue{}
-	for i := 0; i < piecesLen; i++ {
-		queue.Add(i)
-	}
-
-	// 初始化 piece 缓冲区
-	buffer := &PieceBuffer{
-		pieces: make(map[int][]byte),
-	}
-
-	// 启动多个 worker goroutines
-	var wg sync.WaitGroup
-	for i := 0; i < len(peerList); i++ {
-		wg.Add(1)
-		peer := peerList[i] // 创建局部变量，避免闭包问题
-		go func(peer Address) {
-			defer wg.Done()
-			err := downloadPieceWithPeer(peer, infoDict, queue, buffer, infoHashBytes)
-			if err != nil {
-				// 记录错误但不中断其他 workers
-				fmt.Fprintf(os.Stderr, "Worker error with peer %s:%d: %v\n", peer.IP, peer.Port, err)
-			}
-		}(peer)
-	}
-
-	// 等待所有 workers 完成
-	wg.Wait()
-
-	// 检查是否所有 pieces 都已下载
-	if !buffer.HasAll(piecesLen) {
-		downloaded := buffer.Size()
-		return fmt.Errorf("not all pieces downloaded: %d/%d pieces downloaded", downloaded, piecesLen)
-	}
-
-	// 组合所有 pieces 成完整文件
-	combinedFileData, err := combinePieces(buffer.pieces, dataLen)
-	if err != nil {
-		return fmt.Errorf("error combining pieces: %v", err)
-	}
-
-	// 保存文件
-	err = os.WriteFile(savePath, combinedFileData, 0644)
+	// 只加载一次 torrent 文件
+	meta, err := loadMetainfo(torrentFile)
 	if err != nil {
-		return fmt.Errorf("error writing combined file: %v", err)
+		return fmt.Errorf("error loading torrent file: %v", err)
 	}
 
-	return nil
+	return downloadToPath(&meta.Info, savePath, func() (map[int][]byte, error) {
+		// web seed（url-list）作为额外的 piece 来源，与 peers 共用同一个工作队列
+		infoHashes := meta.SwarmInfoHashes()
+		_, peerList := getPeerAddressFromMetainfo(meta)
+		if len(peerList) == 0 && len(meta.WebSeeds) == 0 {
+			return nil, fmt.Errorf("no peers found")
+		}
+		return downloadAllPieces(&meta.Info, peerList, meta.WebSeeds, func(peer Address, queue *WorkQueue, buffer *PieceBuffer) error {
+			return downloadPieceWithPeer(peer, &meta.Info, queue, buffer, infoHashes, meta.InfoBytes)
+		})
+	})
 }
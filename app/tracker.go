@@ -0,0 +1,218 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// trackerHTTPClient 用于所有 tracker 请求
+// 设置超时，避免一个没有响应的 tracker 卡住整个故障转移过程
+var trackerHTTPClient = &http.Client{Timeout: 15 * time.Second}
+
+// minTrackerPeers 是 newTrackerTiers 创建的 TrackerTiers 希望收集到的 peer 数量（TrackerTiers.minPeers）
+// 已经响应的层级返回的 peer 合计少于这个数量时，继续向下一个层级请求并合并结果
+const minTrackerPeers = 30
+
+// trackerResponse 是 tracker 返回的 bencoded 字典
+type trackerResponse struct {
+	FailureReason string `bencode:"failure reason,omitempty"`
+	Interval      int    `bencode:"interval,omitempty"`
+	Peers         string `bencode:"peers"` // 紧凑格式
+}
+
+// decodeTrackerResponse 从响应体解析 tracker 响应
+func decodeTrackerResponse(r io.Reader) (trackerResponse, error) {
+	var trackerResp trackerResponse
+	node, err := NewBencodeDecoder(r).Decode()
+	if err != nil {
+		return trackerResp, err
+	}
+	err = unmarshalBencodeNode(node, &trackerResp)
+	if err != nil {
+		return trackerResp, err
+	}
+	if trackerResp.FailureReason != "" {
+		return trackerResp, fmt.Errorf("tracker failure: %s", trackerResp.FailureReason)
+	}
+	if node.Get("peers") == nil {
+		return trackerResp, errors.New("'peers' key not found in tracker response")
+	}
+	return trackerResp, nil
+}
+
+// announceRequest 是向 tracker 发送 announce 请求时的参数
+type announceRequest struct {
+	InfoHash []byte // 20 字节
+	PeerID   []byte // 20 字节
+	Left     int64  // 剩余需要下载的字节数
+}
+
+// announceToTracker 向单个 HTTP tracker 发送 announce 请求，返回 peer 列表
+func announceToTracker(trackerURL string, req announceRequest) ([]Address, error) {
+	parsedURL, err := url.Parse(trackerURL)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing tracker URL: %v", err)
+	}
+	if parsedURL.Scheme != "http" && parsedURL.Scheme != "https" {
+		return nil, fmt.Errorf("unsupported tracker protocol %q", parsedURL.Scheme)
+	}
+
+	// 手动构建查询字符串以确保 info_hash 和 peer_id 正确编码
+	queryParts := []string{
+		"info_hash=" + url.QueryEscape(string(req.InfoHash)),
+		"peer_id=" + url.QueryEscape(string(req.PeerID)),
+		"port=6881",
+		"uploaded=0",
+		"downloaded=0",
+		"left=" + strconv.FormatInt(req.Left, 10),
+		"compact=1",
+	}
+	// 保留 announce URL 中原有的查询参数（有些私有 tracker 用它携带 passkey）
+	if parsedURL.RawQuery != "" {
+		queryParts = append([]string{parsedURL.RawQuery}, queryParts...)
+	}
+	parsedURL.RawQuery = strings.Join(queryParts, "&")
+
+	// 发送 HTTP GET 请求
+	resp, err := trackerHTTPClient.Get(parsedURL.String())
+	if err != nil {
+		return nil, fmt.Errorf("error making request to tracker: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("error: tracker returned status code %d", resp.StatusCode)
+	}
+
+	// 直接从响应体流式解析 bencoded 响应
+	trackerResp, err := decodeTrackerResponse(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding tracker response: %v", err)
+	}
+	return parseCompactPeers([]byte(trackerResp.Peers))
+}
+
+// parseCompactPeers 解析紧凑格式的 peers：每个 peer 6 字节，前 4 字节是 IP，后 2 字节是端口
+func parseCompactPeers(peersBytes []byte) ([]Address, error) {
+	if len(peersBytes)%6 != 0 {
+		return nil, fmt.Errorf("error: invalid peers format, length is %d (should be multiple of 6)", len(peersBytes))
+	}
+	var addresses []Address
+	for i := 0; i < len(peersBytes); i += 6 {
+		ip := fmt.Sprintf("%d.%d.%d.%d", peersBytes[i], peersBytes[i+1], peersBytes[i+2], peersBytes[i+3])
+		port := int(peersBytes[i+4])<<8 | int(peersBytes[i+5])
+		addresses = append(addresses, Address{IP: ip, Port: port})
+	}
+	return addresses, nil
+}
+
+// TrackerTiers 是按 BEP 12（announce-list）组织的多层 tracker 列表
+// 规则：
+//   - 每一层内部的 tracker 在创建时随机打乱
+//   - 按顺序尝试每一层，层内依次尝试，直到有 tracker 响应；响应的 tracker 被移到本层最前面，
+//     之后的 Announce 先尝试它，所以同一个 torrent 或磁力链接在整个会话中只使用一个 TrackerTiers
+//   - 每一层只使用第一个响应的 tracker，同一层的其他 tracker 是它的备用，不会再请求
+//   - 整层都失败时尝试下一层
+//   - 已经响应的层级返回的 peer 合计不少于 minPeers 时停止；少于 minPeers 时继续向下一层请求，
+//     所有响应的 tracker 返回的 peer 合并去重。minPeers 为 0 时与 BEP 12 相同，第一个有 tracker 响应的层级之后就停止
+type TrackerTiers struct {
+	mu       sync.Mutex
+	tiers    [][]string
+	minPeers int
+}
+
+// newTrackerTiers 根据 announce 和 announce-list 创建 tracker 列表
+// 按照 BEP 12，存在 announce-list 时忽略 announce
+func newTrackerTiers(announce string, announceList [][]string) *TrackerTiers {
+	var tiers [][]string
+	for _, tier := range announceList {
+		var urls []string
+		for _, trackerURL := range tier {
+			if trackerURL != "" {
+				urls = append(urls, trackerURL)
+			}
+		}
+		if len(urls) == 0 {
+			continue
+		}
+		rand.Shuffle(len(urls), func(i, j int) { urls[i], urls[j] = urls[j], urls[i] })
+		tiers = append(tiers, urls)
+	}
+	if len(tiers) == 0 && announce != "" {
+		tiers = [][]string{{announce}}
+	}
+	return &TrackerTiers{tiers: tiers, minPeers: minTrackerPeers}
+}
+
+// Tiers 返回当前的 tracker 顺序（副本）
+func (t *TrackerTiers) Tiers() [][]string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	tiers := make([][]string, len(t.tiers))
+	for i, tier := range t.tiers {
+		tiers[i] = append([]string(nil), tier...)
+	}
+	return tiers
+}
+
+// Announce 按层级顺序向 tracker 请求 peer 列表（规则见 TrackerTiers），返回合并去重后的结果
+// 所有 tracker 都失败时返回最后一个错误
+func (t *TrackerTiers) Announce(req announceRequest) ([]Address, error) {
+	tiers := t.Tiers()
+	if len(tiers) == 0 {
+		return nil, errors.New("no trackers found in 'announce' or 'announce-list'")
+	}
+
+	var peers []Address
+	seen := make(map[Address]bool)
+	var lastErr error
+	responded := false
+	for tierIndex, tier := range tiers {
+		for _, trackerURL := range tier {
+			addresses, err := announceToTracker(trackerURL, req)
+			if err != nil {
+				lastErr = fmt.Errorf("tracker %s: %v", trackerURL, err)
+				continue // 尝试本层的下一个 tracker
+			}
+			t.promote(tierIndex, trackerURL)
+			responded = true
+			for _, address := range addresses {
+				if !seen[address] {
+					seen[address] = true
+					peers = append(peers, address)
+				}
+			}
+			break // 本层已经有 tracker 响应
+		}
+		if responded && len(peers) >= t.minPeers {
+			break
+		}
+	}
+
+	if len(peers) == 0 && lastErr != nil {
+		return nil, lastErr
+	}
+	return peers, nil
+}
+
+// promote 把响应的 tracker 移到所在层级的最前面
+func (t *TrackerTiers) promote(tierIndex int, trackerURL string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	tier := t.tiers[tierIndex]
+	for i, u := range tier {
+		if u == trackerURL {
+			copy(tier[1:i+1], tier[:i])
+			tier[0] = trackerURL
+			return
+		}
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"slices"
+	"sync/atomic"
+	"testing"
+)
+
+// testTracker 是返回固定 peer 列表的 HTTP tracker，failure 不为空时返回 failure reason，记录收到的 announce 次数
+type testTracker struct {
+	URL  string
+	hits atomic.Int32
+}
+
+func startTrackerForTest(t *testing.T, peers []Address, failure string) *testTracker {
+	t.Helper()
+	tracker := &testTracker{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tracker.hits.Add(1)
+		response := map[string]interface{}{"failure reason": failure}
+		if failure == "" {
+			var compact []byte
+			for _, peer := range peers {
+				compact = append(compact, 127, 0, 0, 1, byte(peer.Port>>8), byte(peer.Port))
+			}
+			response = map[string]interface{}{"interval": 60, "peers": compact}
+		}
+		encoded, _ := Marshal(response)
+		w.Write(encoded)
+	}))
+	t.Cleanup(server.Close)
+	tracker.URL = server.URL + "/announce"
+	return tracker
+}
+
+// testPeers 返回 127.0.0.1 上端口为 ports 的地址
+func testPeers(ports ...int) []Address {
+	var peers []Address
+	for _, port := range ports {
+		peers = append(peers, Address{IP: "127.0.0.1", Port: port})
+	}
+	return peers
+}
+
+func announceForTest(t *testing.T, tiers *TrackerTiers) []Address {
+	t.Helper()
+	peers, err := tiers.Announce(announceRequest{InfoHash: make([]byte, 20), PeerID: make([]byte, 20), Left: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return peers
+}
+
+func TestTrackerTiersFailover(t *testing.T) {
+	failing := startTrackerForTest(t, nil, "overloaded")
+	good := startTrackerForTest(t, testPeers(1), "")
+	standby := startTrackerForTest(t, testPeers(2), "")
+
+	// 同一层中失败的 tracker 换下一个，响应之后同层的其他 tracker 不再请求
+	tiers := &TrackerTiers{tiers: [][]string{{failing.URL, good.URL, standby.URL}}}
+	if peers := announceForTest(t, tiers); !slices.Equal(peers, testPeers(1)) {
+		t.Fatalf("got peers %v", peers)
+	}
+	if failing.hits.Load() != 1 || good.hits.Load() != 1 || standby.hits.Load() != 0 {
+		t.Fatalf("hits: failing %d, good %d, standby %d", failing.hits.Load(), good.hits.Load(), standby.hits.Load())
+	}
+
+	// 整层都失败时使用下一层
+	tiers = &TrackerTiers{tiers: [][]string{{failing.URL}, {standby.URL}}}
+	if peers := announceForTest(t, tiers); !slices.Equal(peers, testPeers(2)) {
+		t.Fatalf("got peers %v", peers)
+	}
+
+	// 所有 tracker 都失败时返回错误
+	tiers = &TrackerTiers{tiers: [][]string{{failing.URL}, {failing.URL}}}
+	if _, err := tiers.Announce(announceRequest{InfoHash: make([]byte, 20), PeerID: make([]byte, 20)}); err == nil {
+		t.Fatal("expected an error when every tracker fails")
+	}
+}
+
+func TestTrackerTiersPromotion(t *testing.T) {
+	failing := startTrackerForTest(t, nil, "overloaded")
+	good := startTrackerForTest(t, testPeers(1), "")
+
+	tiers := &TrackerTiers{tiers: [][]string{{failing.URL, good.URL}}}
+	announceForTest(t, tiers)
+	if order := tiers.Tiers()[0]; !slices.Equal(order, []string{good.URL, failing.URL}) {
+		t.Fatalf("responding tracker was not promoted: %q", order)
+	}
+	// 之后的请求直接使用提升后的 tracker
+	announceForTest(t, tiers)
+	announceForTest(t, tiers)
+	if failing.hits.Load() != 1 || good.hits.Load() != 3 {
+		t.Fatalf("hits: failing %d, good %d", failing.hits.Load(), good.hits.Load())
+	}
+
+	// torrent 在整个会话中使用同一个 TrackerTiers，提升在多次 requestPeers 之间保留
+	root := filepath.Join(t.TempDir(), "data")
+	writeTestFiles(t, root, map[string]int{"a": 1000})
+	meta, err := createTorrent(CreateOptions{Path: root, Trackers: [][]string{{failing.URL, good.URL}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta, err = reparseTorrent(t, meta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	failing.hits.Store(0)
+	for i := 0; i < 3; i++ {
+		if _, err := requestPeers(meta); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if failing.hits.Load() > 1 {
+		t.Fatalf("failing tracker was asked %d times, promotion was lost between requests", failing.hits.Load())
+	}
+
+	magnet, err := decodeMagnetLink("magnet:?xt=urn:btih:" + "0123456789abcdef0123456789abcdef01234567" + "&tr=" + failing.URL + "&tr=" + good.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if magnet.announceTiers() != magnet.announceTiers() {
+		t.Fatal("magnet link created a new TrackerTiers for each request")
+	}
+}
+
+func TestTrackerTiersMerge(t *testing.T) {
+	first := startTrackerForTest(t, testPeers(1, 2), "")
+	firstStandby := startTrackerForTest(t, testPeers(9), "")
+	second := startTrackerForTest(t, testPeers(2, 3), "")
+	third := startTrackerForTest(t, testPeers(4), "")
+	tierList := [][]string{{first.URL, firstStandby.URL}, {second.URL}, {third.URL}}
+
+	// minPeers 为 0 时与 BEP 12 相同，第一个有 tracker 响应的层级之后就停止
+	tiers := &TrackerTiers{tiers: tierList}
+	if peers := announceForTest(t, tiers); !slices.Equal(peers, testPeers(1, 2)) {
+		t.Fatalf("minPeers 0: got peers %v", peers)
+	}
+
+	// peer 不够时继续请求下一层，合并去重，够了就停止
+	tiers = &TrackerTiers{tiers: tierList, minPeers: 3}
+	if peers := announceForTest(t, tiers); !slices.Equal(peers, testPeers(1, 2, 3)) {
+		t.Fatalf("minPeers 3: got peers %v", peers)
+	}
+	if firstStandby.hits.Load() != 0 || third.hits.Load() != 0 {
+		t.Fatalf("hits: first tier standby %d, third tier %d", firstStandby.hits.Load(), third.hits.Load())
+	}
+
+	// 所有层级的 peer 加起来也不够时，返回所有响应的 tracker 的 peer
+	tiers = &TrackerTiers{tiers: tierList, minPeers: 10}
+	if peers := announceForTest(t, tiers); !slices.Equal(peers, testPeers(1, 2, 3, 4)) {
+		t.Fatalf("minPeers 10: got peers %v", peers)
+	}
+}
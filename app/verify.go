@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"runtime"
+	"strings"
+	"sync"
+)
+
+// pieceStatus 是 verify 命令中一个 piece 的检查结果
+type pieceStatus int
+
+const (
+	pieceGood    pieceStatus = iota
+	pieceBad                 // 数据存在但哈希不匹配
+	pieceMissing             // 覆盖这个 piece 的文件不存在或长度不足
+)
+
+// VerifyReport 是 verify 命令的检查结果
+type VerifyReport struct {
+	info     *InfoDict
+	statuses []pieceStatus
+	Good     int
+	Bad      int
+	Missing  int
+}
+
+// OK 判断所有 piece 是否都通过了校验
+func (r *VerifyReport) OK() bool {
+	return r.Bad == 0 && r.Missing == 0
+}
+
+// verifyData 按 piece 读取 path 下的数据并用 torrent 中的哈希校验
+// path 的含义与 download 的输出路径相同：单文件 torrent 是文件路径，多文件 torrent 是目录
+func verifyData(meta *Metainfo, path string) (*VerifyReport, error) {
+	storage, err := newFileStorage(&meta.Info, path)
+	if err != nil {
+		return nil, err
+	}
+	info := &meta.Info
+	report := &VerifyReport{info: info, statuses: make([]pieceStatus, info.NumPieces())}
+
+	// 每个 worker 只写自己负责的 piece 的结果，不需要加锁
+	indexes := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < runtime.NumCPU(); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for pieceIndex := range indexes {
+				report.statuses[pieceIndex] = verifyStoredPiece(storage, info, pieceIndex)
+			}
+		}()
+	}
+	for pieceIndex := range report.statuses {
+		indexes <- pieceIndex
+	}
+	close(indexes)
+	wg.Wait()
+
+	for _, status := range report.statuses {
+		switch status {
+		case pieceGood:
+			report.Good++
+		case pieceBad:
+			report.Bad++
+		case pieceMissing:
+			report.Missing++
+		}
+	}
+	return report, nil
+}
+
+// verifyStoredPiece 检查磁盘上的一个 piece
+func verifyStoredPiece(storage *FileStorage, info *InfoDict, pieceIndex int) pieceStatus {
+	pieceLength, err := info.PieceSize(pieceIndex)
+	if err != nil {
+		return pieceBad
+	}
+	offset := int64(pieceIndex) * info.PieceLength
+	if !storage.HasRange(offset, int64(pieceLength)) {
+		return pieceMissing
+	}
+	data := make([]byte, pieceLength)
+	_, err = storage.ReadAt(data, offset)
+	if err != nil {
+		return pieceMissing
+	}
+	if info.VerifyPiece(pieceIndex, data) != nil {
+		return pieceBad
+	}
+	return pieceGood
+}
+
+// String 格式化检查结果：各状态的 piece 数量，以及每一段连续的坏 piece 的字节范围和涉及的文件
+func (r *VerifyReport) String() string {
+	var result strings.Builder
+	result.WriteString(fmt.Sprintf("Pieces: %d\nGood: %d\nBad: %d\nMissing: %d", len(r.statuses), r.Good, r.Bad, r.Missing))
+	for first := 0; first < len(r.statuses); first++ {
+		if r.statuses[first] != pieceBad {
+			continue
+		}
+		last := first
+		for last+1 < len(r.statuses) && r.statuses[last+1] == pieceBad {
+			last++
+		}
+		start := int64(first) * r.info.PieceLength
+		lastLength, _ := r.info.PieceSize(last)
+		end := int64(last)*r.info.PieceLength + int64(lastLength)
+		if first == last {
+			result.WriteString(fmt.Sprintf("\nBad piece %d: bytes %d-%d", first, start, end-1))
+		} else {
+			result.WriteString(fmt.Sprintf("\nBad pieces %d-%d: bytes %d-%d", first, last, start, end-1))
+		}
+		if files := r.filesInRange(start, end); len(files) > 0 {
+			result.WriteString(" (" + strings.Join(files, ", ") + ")")
+		}
+		first = last
+	}
+	return result.String()
+}
+
+// filesInRange 返回数据流中 [start, end) 范围涉及的文件
+func (r *VerifyReport) filesInRange(start int64, end int64) []string {
+	var files []string
+	for _, file := range r.info.Files() {
+		if file.Length > 0 && file.Offset < end && file.Offset+file.Length > start {
+			files = append(files, strings.Join(file.Path, "/"))
+		}
+	}
+	return files
+}
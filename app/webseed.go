@@ -0,0 +1,152 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// webSeedHTTPClient 用于所有 web seed 请求，测试时可以替换
+var webSeedHTTPClient = &http.Client{Timeout: 60 * time.Second}
+
+// maxWebSeedFailures 是 web seed 连续失败多少次后停止使用
+const maxWebSeedFailures = 3
+
+// WebSeed 是 BEP 19（url-list）中的一个 HTTP 源
+// 单文件 torrent：URL 以 "/" 结尾时文件地址是 URL + name，否则 URL 就是文件地址
+// 多文件 torrent：文件地址是 URL + name + "/" + 文件路径
+type WebSeed struct {
+	URL    string
+	Client *http.Client
+}
+
+// parseURLList 解析 url-list：可以是单个字符串，也可以是字符串列表，忽略空字符串和其他类型的项
+func parseURLList(node *BencodeNode) []string {
+	if node == nil {
+		return nil
+	}
+	items := []*BencodeNode{node}
+	if node.Kind == 'l' {
+		items = node.List
+	}
+	var urls []string
+	for _, item := range items {
+		if item.Kind == 's' && item.Value.(string) != "" {
+			urls = append(urls, item.Value.(string))
+		}
+	}
+	return urls
+}
+
+// fileURL 返回 torrent 中某个文件在 web seed 上的地址
+func (ws *WebSeed) fileURL(info *InfoDict, file FileEntry) string {
+	if !info.IsMultiFile() && !strings.HasSuffix(ws.URL, "/") {
+		return ws.URL
+	}
+	base := ws.URL
+	if !strings.HasSuffix(base, "/") {
+		base += "/"
+	}
+	// file.Path 的第一个分量就是 name（单文件 torrent 只有 name）
+	escaped := make([]string, len(file.Path))
+	for i, component := range file.Path {
+		escaped[i] = url.PathEscape(component)
+	}
+	return base + strings.Join(escaped, "/")
+}
+
+// fetchPiece 用 HTTP Range 请求下载一个 piece，并校验哈希
+// piece 跨越多个文件时对每个文件分别请求；不属于任何文件的部分（填充文件等）保持为零
+func (ws *WebSeed) fetchPiece(info *InfoDict, pieceIndex int) ([]byte, error) {
+	pieceLength, err := info.PieceSize(pieceIndex)
+	if err != nil {
+		return nil, err
+	}
+	piece := make([]byte, pieceLength)
+	start := int64(pieceIndex) * info.PieceLength
+	end := start + int64(pieceLength)
+	for _, file := range info.Files() {
+		fileEnd := file.Offset + file.Length
+		if file.Length == 0 || fileEnd <= start || file.Offset >= end {
+			continue
+		}
+		from := max(start, file.Offset)
+		to := min(end, fileEnd)
+		err = ws.fetchRange(ws.fileURL(info, file), from-file.Offset, piece[from-start:to-start])
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = info.VerifyPiece(pieceIndex, piece)
+	if err != nil {
+		return nil, err
+	}
+	return piece, nil
+}
+
+// fetchRange 从 fileURL 的 offset 处读取 len(buffer) 字节
+func (ws *WebSeed) fetchRange(fileURL string, offset int64, buffer []byte) error {
+	req, err := http.NewRequest(http.MethodGet, fileURL, nil)
+	if err != nil {
+		return fmt.Errorf("error creating web seed request: %v", err)
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+int64(len(buffer))-1))
+	resp, err := ws.Client.Do(req)
+	if err != nil {
+		return fmt.Errorf("error requesting web seed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	body := io.Reader(resp.Body)
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+	case http.StatusOK:
+		// 服务器不支持 Range，返回了整个文件，跳过前面不需要的部分
+		_, err = io.CopyN(io.Discard, body, offset)
+		if err != nil {
+			return fmt.Errorf("error reading web seed response: %v", err)
+		}
+	default:
+		return fmt.Errorf("error: web seed returned status code %d for %s", resp.StatusCode, fileURL)
+	}
+	_, err = io.ReadFull(body, buffer)
+	if err != nil {
+		return fmt.Errorf("error reading web seed response: %v", err)
+	}
+	return nil
+}
+
+// downloadPiecesFromWebSeed 与 downloadPieceWithPeer 一样从共享的队列中取 piece，通过 web seed 下载
+// 下载失败的 piece 放回队列，由其他 peer 或 web seed 重试；连续失败多次后停止使用这个 web seed
+func downloadPiecesFromWebSeed(ws *WebSeed, info *InfoDict, queue *WorkQueue, buffer *PieceBuffer) error {
+	failures := 0
+	for {
+		pieceIndex, ok := queue.Get(ws.URL)
+		if !ok {
+			return nil
+		}
+		// 检查这个 piece 是否已经下载
+		if _, exists := buffer.Get(pieceIndex); exists {
+			queue.Done(pieceIndex)
+			continue
+		}
+
+		data, err := ws.fetchPiece(info, pieceIndex)
+		if err != nil {
+			// 下载失败，放回队列重试（web seed 的失败只计入它自己的重试次数）
+			queue.Retry(ws.URL, pieceIndex)
+			failures++
+			if failures >= maxWebSeedFailures {
+				return fmt.Errorf("giving up on web seed after %d failures: %v", failures, err)
+			}
+			continue
+		}
+		failures = 0
+		buffer.Set(pieceIndex, data)
+		queue.Done(pieceIndex)
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// testWebSeedServer 用 http.FileServer 提供 dir 下的文件（支持 Range），记录每个请求的路径和 Range 头
+type testWebSeedServer struct {
+	URL string
+
+	mu       sync.Mutex
+	requests []string // "路径 Range"
+}
+
+func startTestWebSeed(t *testing.T, dir string) *testWebSeedServer {
+	t.Helper()
+	s := &testWebSeedServer{}
+	files := http.FileServer(http.Dir(dir))
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		s.requests = append(s.requests, r.URL.Path+" "+r.Header.Get("Range"))
+		s.mu.Unlock()
+		files.ServeHTTP(w, r)
+	}))
+	t.Cleanup(server.Close)
+	s.URL = server.URL
+	return s
+}
+
+// takeRequests 返回并清空记录的请求
+func (s *testWebSeedServer) takeRequests() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	requests := s.requests
+	s.requests = nil
+	return requests
+}
+
+func TestWebSeedSingleFile(t *testing.T) {
+	dir := t.TempDir()
+	data := writeTestFiles(t, dir, map[string]int{"single file.bin": 40000})["single file.bin"]
+	meta, err := createTorrent(CreateOptions{Path: filepath.Join(dir, "single file.bin"), PieceLength: 16384})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := startTestWebSeed(t, dir)
+
+	tests := []struct {
+		url  string
+		path string
+	}{
+		{server.URL + "/", "/single file.bin"},                  // 以 "/" 结尾：URL + name
+		{server.URL + "/single%20file.bin", "/single file.bin"}, // 否则 URL 就是文件地址
+	}
+	for _, test := range tests {
+		ws := &WebSeed{URL: test.url, Client: http.DefaultClient}
+		piece, err := ws.fetchPiece(&meta.Info, 2)
+		if err != nil {
+			t.Fatalf("%s: %v", test.url, err)
+		}
+		if !bytes.Equal(piece, data[32768:]) {
+			t.Fatalf("%s: piece data mismatch", test.url)
+		}
+		requests := server.takeRequests()
+		expected := []string{test.path + " bytes=32768-39999"}
+		if !slices.Equal(requests, expected) {
+			t.Fatalf("%s: requests %q, expected %q", test.url, requests, expected)
+		}
+	}
+}
+
+func TestWebSeedMultiFile(t *testing.T) {
+	dir := t.TempDir()
+	root := filepath.Join(dir, "multi dir")
+	data := writeTestFiles(t, root, map[string]int{"a": 10000, "b c": 3000, "sub/d": 20000})
+	meta, err := createTorrent(CreateOptions{Path: root, PieceLength: 16384})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream := slices.Concat(data["a"], data["b c"], data["sub/d"])
+	server := startTestWebSeed(t, dir)
+
+	// 多文件 torrent 的 URL 不管是否以 "/" 结尾，都会加上 name 作为目录
+	for _, seedURL := range []string{server.URL + "/", server.URL} {
+		ws := &WebSeed{URL: seedURL, Client: http.DefaultClient}
+		// piece 0 跨越三个文件，每个文件单独发一个 Range 请求
+		piece, err := ws.fetchPiece(&meta.Info, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(piece, stream[:16384]) {
+			t.Fatal("piece 0 data mismatch")
+		}
+		requests := server.takeRequests()
+		expected := []string{
+			"/multi dir/a bytes=0-9999",
+			"/multi dir/b c bytes=0-2999",
+			"/multi dir/sub/d bytes=0-3383",
+		}
+		if !slices.Equal(requests, expected) {
+			t.Fatalf("%s: requests %q, expected %q", seedURL, requests, expected)
+		}
+
+		// 最后一个 piece 只在一个文件的中间
+		piece, err = ws.fetchPiece(&meta.Info, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(piece, stream[32768:]) {
+			t.Fatal("piece 2 data mismatch")
+		}
+		requests = server.takeRequests()
+		expected = []string{"/multi dir/sub/d bytes=19768-19999"}
+		if !slices.Equal(requests, expected) {
+			t.Fatalf("%s: requests %q, expected %q", seedURL, requests, expected)
+		}
+	}
+}
+
+func TestWebSeedHashMismatch(t *testing.T) {
+	dir := t.TempDir()
+	root := filepath.Join(dir, "multi")
+	data := writeTestFiles(t, root, map[string]int{"a": 10000, "b": 30000})
+	meta, err := createTorrent(CreateOptions{Path: root, PieceLength: 16384})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 服务器上 b 的第二个 piece 范围内的内容被改动，第一个 piece 仍然正确
+	corrupted := bytes.Clone(data["b"])
+	corrupted[len(corrupted)-1] ^= 0xff
+	if err := os.WriteFile(filepath.Join(root, "b"), corrupted, 0644); err != nil {
+		t.Fatal(err)
+	}
+	server := startTestWebSeed(t, dir)
+	ws := &WebSeed{URL: server.URL, Client: http.DefaultClient}
+
+	if _, err := ws.fetchPiece(&meta.Info, 0); err != nil {
+		t.Fatalf("piece 0: %v", err)
+	}
+	if _, err := ws.fetchPiece(&meta.Info, 2); err == nil {
+		t.Fatal("piece with corrupted data was accepted")
+	}
+
+	// 下载循环只保存校验通过的 piece，连续失败后放弃这个 web seed
+	queue := &WorkQueue{}
+	queue.Add(0)
+	queue.Add(2)
+	buffer := &PieceBuffer{pieces: make(map[int][]byte)}
+	err = downloadPiecesFromWebSeed(ws, &meta.Info, queue, buffer)
+	if err == nil || !strings.Contains(err.Error(), "giving up") {
+		t.Fatalf("expected web seed to be given up, got %v", err)
+	}
+	if _, ok := buffer.Get(0); !ok {
+		t.Fatal("good piece was not stored")
+	}
+	if _, ok := buffer.Get(2); ok {
+		t.Fatal("corrupted piece was stored")
+	}
+	// 失败的 piece 放回了队列，peer 仍然可以下载它，这个 web seed 不会再取它
+	if queue.Size() != 1 {
+		t.Fatalf("expected the failed piece to be queued again, queue has %d pieces", queue.Size())
+	}
+	if piece, ok := queue.Get("peer"); !ok || piece != 2 {
+		t.Fatalf("peer could not take the failed piece: %d, %v", piece, ok)
+	}
+	queue.Retry("peer", 2)
+	if _, ok := queue.Get(ws.URL); ok {
+		t.Fatal("web seed took a piece it already failed too often")
+	}
+}